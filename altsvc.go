@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// altSvcTimeFormat is the format of the expiry dates in the cache file.
+const altSvcTimeFormat = "20060102 15:04:05"
+
+// altSvc is an alternative service advertised by an origin with the Alt-Svc
+// response header (RFC 7838).
+type altSvc struct {
+	srcALPN, srcHost, srcPort string
+	dstALPN, dstHost, dstPort string
+	expires                   time.Time
+	persist                   bool
+}
+
+// altSvcCache holds the alternative services, read from and saved to the
+// --alt-svc file. The file format is the one of cURL, one entry per line:
+//
+//	h2 example.com 443 h3 example.com 443 "20260102 15:04:05" 0 0
+type altSvcCache struct {
+	file    string
+	mu      sync.Mutex
+	entries []altSvc
+}
+
+// loadAltSvc reads the alternative services cache from file. A missing file
+// is an empty cache, it is created on the first update.
+func loadAltSvc(file string) (*altSvcCache, error) {
+	c := &altSvcCache{file: file}
+
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the alt-svc cache; %s", err)
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		// The date has a space in it, the fields are split around it.
+		before, rest, ok := strings.Cut(line, "\"")
+		if !ok {
+			continue
+		}
+		date, after, ok := strings.Cut(rest, "\"")
+		if !ok {
+			continue
+		}
+		f := strings.Fields(before)
+		tail := strings.Fields(after)
+		if len(f) != 6 || len(tail) < 1 {
+			continue
+		}
+		expires, err := time.Parse(altSvcTimeFormat, date)
+		if err != nil {
+			continue
+		}
+		c.entries = append(c.entries, altSvc{
+			srcALPN: f[0], srcHost: f[1], srcPort: f[2],
+			dstALPN: f[3], dstHost: f[4], dstPort: f[5],
+			expires: expires,
+			persist: tail[0] == "1",
+		})
+	}
+	return c, nil
+}
+
+// lookup returns the address of the HTTP/3 alternative service of the origin
+// addr ("host:port"), if one is cached and not expired.
+func (c *altSvcCache) lookup(addr string) (string, bool) {
+	if c == nil {
+		return "", false
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for _, e := range c.entries {
+		if e.dstALPN == "h3" && strings.EqualFold(e.srcHost, host) && e.srcPort == port && now.Before(e.expires) {
+			return net.JoinHostPort(e.dstHost, e.dstPort), true
+		}
+	}
+	return "", false
+}
+
+// update replaces the alternative services of the origin addr, reached with
+// the protocol proto, with the ones of the Alt-Svc header value, then saves
+// the cache.
+func (c *altSvcCache) update(addr, proto, header string) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	services, clear := parseAltSvc(header, time.Now())
+	if !clear && len(services) == 0 {
+		return nil
+	}
+
+	srcALPN := "h1"
+	switch proto {
+	case "HTTP/2":
+		srcALPN = "h2"
+	case "HTTP/3":
+		srcALPN = "h3"
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entries := c.entries[:0]
+	for _, e := range c.entries {
+		if !strings.EqualFold(e.srcHost, host) || e.srcPort != port {
+			entries = append(entries, e)
+		}
+	}
+	for _, s := range services {
+		s.srcALPN, s.srcHost, s.srcPort = srcALPN, strings.ToLower(host), port
+		if s.dstHost == "" {
+			s.dstHost = s.srcHost
+		}
+		entries = append(entries, s)
+	}
+	c.entries = entries
+	return c.save()
+}
+
+// save writes the cache to its file. The caller holds c.mu.
+func (c *altSvcCache) save() error {
+	var buf bytes.Buffer
+	buf.WriteString("# Your alt-svc cache. https://curl.se/docs/alt-svc.html\n")
+	buf.WriteString("# This file was generated by kurly! Edit at your own risk.\n")
+	for _, e := range c.entries {
+		persist := 0
+		if e.persist {
+			persist = 1
+		}
+		fmt.Fprintf(&buf, "%s %s %s %s %s %s \"%s\" %d 0\n",
+			e.srcALPN, e.srcHost, e.srcPort, e.dstALPN, e.dstHost, e.dstPort,
+			e.expires.UTC().Format(altSvcTimeFormat), persist)
+	}
+	if err := ioutil.WriteFile(c.file, buf.Bytes(), 0600); err != nil {
+		return fmt.Errorf("unable to save the alt-svc cache; %s", err)
+	}
+	return nil
+}
+
+// parseAltSvc parses an Alt-Svc header value, like
+// `h3=":443"; ma=86400, h2="alt.example.com:443"`. The source of the
+// returned entries is left empty. clear is true for the "clear" value, which
+// removes every alternative service of the origin.
+func parseAltSvc(header string, now time.Time) (services []altSvc, clear bool) {
+	header = strings.TrimSpace(header)
+	if header == "clear" {
+		return nil, true
+	}
+
+	for _, alt := range splitQuoted(header, ',') {
+		params := splitQuoted(alt, ';')
+		proto, value, ok := strings.Cut(strings.TrimSpace(params[0]), "=")
+		if !ok {
+			continue
+		}
+		host, port, err := net.SplitHostPort(strings.Trim(value, "\""))
+		if err != nil || port == "" {
+			continue
+		}
+		s := altSvc{
+			dstALPN: strings.TrimSpace(proto),
+			dstHost: strings.Trim(host, "[]"),
+			dstPort: port,
+			expires: now.Add(24 * time.Hour),
+		}
+		for _, p := range params[1:] {
+			k, v, _ := strings.Cut(strings.TrimSpace(p), "=")
+			v = strings.Trim(v, "\"")
+			switch strings.ToLower(k) {
+			case "ma":
+				if secs, err := strconv.ParseInt(v, 10, 64); err == nil {
+					s.expires = now.Add(time.Duration(secs) * time.Second)
+				}
+			case "persist":
+				s.persist = v == "1"
+			}
+		}
+		services = append(services, s)
+	}
+	return services, false
+}
+
+// splitQuoted splits s around sep, ignoring the separators within quotes.
+func splitQuoted(s string, sep rune) []string {
+	var parts []string
+	quoted, start := false, 0
+	for i, r := range s {
+		switch r {
+		case '"':
+			quoted = !quoted
+		case sep:
+			if !quoted {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, s[start:])
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// errCertExpiry is returned with --cert-expiry-fail when a certificate of the
+// server expires within --cert-expiry-days. cURL has no such check, so kurly
+// exits with the code of the certificates which can't be verified.
+var errCertExpiry = errors.New("SSL: certificate expires soon")
+
+// peerCertificates returns the certificates sent by the server for the last
+// request of the transfer, also when their verification failed with err.
+func (s *transferStats) peerCertificates(err error) []*x509.Certificate {
+	var verifyErr *tls.CertificateVerificationError
+	if errors.As(err, &verifyErr) {
+		return verifyErr.UnverifiedCertificates
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if h := s.hop(); h != nil && h.resp != nil && h.resp.TLS != nil {
+		return h.resp.TLS.PeerCertificates
+	}
+	return nil
+}
+
+// inspectCertificates applies --cert-info, --cert-out and --cert-expiry-days
+// to the certificates of the server of the transfer, err being its outcome,
+// writing the messages to stderr. It returns errCertExpiry when the transfer
+// must fail.
+func (o *Options) inspectCertificates(s *transferStats, err error, stderr io.Writer) error {
+	certs := s.peerCertificates(err)
+	if len(certs) == 0 {
+		return nil
+	}
+	if o.certInfo {
+		// stdout is for the bodies, which may be piped.
+		writeCertInfo(stderr, certs, time.Now())
+	}
+	if o.certFile != nil {
+		if err := writeCertPEM(o.certFile, certs); err != nil {
+			fmt.Fprintf(stderr, "kurly : unable to save the certificates; %s\n", err)
+		}
+	}
+	if o.certExpiryDays > 0 {
+		return o.checkCertExpiry(stderr, certs, time.Now())
+	}
+	return nil
+}
+
+// openCertOut opens the --cert-out file, which receives the chains of all the
+// transfers.
+func (o *Options) openCertOut() (io.WriteCloser, error) {
+	f, err := os.Create(o.certOut)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open the certificate file; %s", err)
+	}
+	return f, nil
+}
+
+// writeCertInfo describes every certificate of the chain, the server one
+// first.
+func writeCertInfo(w io.Writer, certs []*x509.Certificate, now time.Time) {
+	for i, cert := range certs {
+		fmt.Fprintf(w, "Certificate %d:\n", i)
+		fmt.Fprintf(w, "  Subject: %s\n", cert.Subject)
+		if names := subjectAltNames(cert); len(names) > 0 {
+			fmt.Fprintf(w, "  Subject Alternative Names: %s\n", strings.Join(names, ", "))
+		}
+		fmt.Fprintf(w, "  Issuer: %s\n", cert.Issuer)
+		fmt.Fprintf(w, "  Serial Number: %s\n", hexBytes(cert.SerialNumber.Bytes()))
+		fmt.Fprintf(w, "  Not Before: %s\n", cert.NotBefore.UTC().Format(time.RFC1123))
+		fmt.Fprintf(w, "  Not After: %s (%s)\n", cert.NotAfter.UTC().Format(time.RFC1123), expiryDelay(cert, now))
+		fmt.Fprintf(w, "  Public Key: %s\n", publicKeyType(cert))
+		fmt.Fprintf(w, "  Signature Algorithm: %s\n", cert.SignatureAlgorithm)
+		if usage := keyUsages(cert); len(usage) > 0 {
+			fmt.Fprintf(w, "  Key Usage: %s\n", strings.Join(usage, ", "))
+		}
+		if usage := extKeyUsages(cert); len(usage) > 0 {
+			fmt.Fprintf(w, "  Extended Key Usage: %s\n", strings.Join(usage, ", "))
+		}
+		fmt.Fprintf(w, "  CA: %t\n", cert.IsCA)
+		sha256Sum := sha256.Sum256(cert.Raw)
+		sha1Sum := sha1.Sum(cert.Raw)
+		fmt.Fprintf(w, "  SHA-256 Fingerprint: %s\n", hexBytes(sha256Sum[:]))
+		fmt.Fprintf(w, "  SHA-1 Fingerprint: %s\n", hexBytes(sha1Sum[:]))
+	}
+}
+
+// writeCertPEM writes the certificates of the chain in the PEM format.
+func writeCertPEM(w io.Writer, certs []*x509.Certificate) error {
+	for _, cert := range certs {
+		if err := pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkCertExpiry warns on stderr about the certificates of the chain which
+// expire within --cert-expiry-days, failing with --cert-expiry-fail.
+func (o *Options) checkCertExpiry(stderr io.Writer, certs []*x509.Certificate, now time.Time) error {
+	limit := now.Add(time.Duration(o.certExpiryDays) * 24 * time.Hour)
+	var expiring []string
+	for _, cert := range certs {
+		if cert.NotAfter.Before(limit) {
+			expiring = append(expiring, fmt.Sprintf("%s %s", cert.Subject, expiryDelay(cert, now)))
+		}
+	}
+	if len(expiring) == 0 {
+		return nil
+	}
+	if o.certExpiryFail {
+		return fmt.Errorf("%w; %s", errCertExpiry, strings.Join(expiring, ", "))
+	}
+	for _, e := range expiring {
+		fmt.Fprintf(stderr, "Warning : the certificate %s\n", e)
+	}
+	return nil
+}
+
+// expiryDelay tells when cert expires, in days from now.
+func expiryDelay(cert *x509.Certificate, now time.Time) string {
+	days := int(cert.NotAfter.Sub(now).Hours() / 24)
+	switch {
+	case cert.NotAfter.Before(now):
+		return "expired"
+	case days == 0:
+		return "expires today"
+	case days == 1:
+		return "expires in 1 day"
+	}
+	return fmt.Sprintf("expires in %d days", days)
+}
+
+var keyUsageNames = []struct {
+	usage x509.KeyUsage
+	name  string
+}{
+	{x509.KeyUsageDigitalSignature, "Digital Signature"},
+	{x509.KeyUsageContentCommitment, "Content Commitment"},
+	{x509.KeyUsageKeyEncipherment, "Key Encipherment"},
+	{x509.KeyUsageDataEncipherment, "Data Encipherment"},
+	{x509.KeyUsageKeyAgreement, "Key Agreement"},
+	{x509.KeyUsageCertSign, "Certificate Sign"},
+	{x509.KeyUsageCRLSign, "CRL Sign"},
+	{x509.KeyUsageEncipherOnly, "Encipher Only"},
+	{x509.KeyUsageDecipherOnly, "Decipher Only"},
+}
+
+func keyUsages(cert *x509.Certificate) []string {
+	var names []string
+	for _, ku := range keyUsageNames {
+		if cert.KeyUsage&ku.usage != 0 {
+			names = append(names, ku.name)
+		}
+	}
+	return names
+}
+
+func extKeyUsages(cert *x509.Certificate) []string {
+	var names []string
+	for _, eku := range cert.ExtKeyUsage {
+		switch eku {
+		case x509.ExtKeyUsageAny:
+			names = append(names, "Any")
+		case x509.ExtKeyUsageServerAuth:
+			names = append(names, "TLS Web Server Authentication")
+		case x509.ExtKeyUsageClientAuth:
+			names = append(names, "TLS Web Client Authentication")
+		case x509.ExtKeyUsageCodeSigning:
+			names = append(names, "Code Signing")
+		case x509.ExtKeyUsageEmailProtection:
+			names = append(names, "E-mail Protection")
+		case x509.ExtKeyUsageTimeStamping:
+			names = append(names, "Time Stamping")
+		case x509.ExtKeyUsageOCSPSigning:
+			names = append(names, "OCSP Signing")
+		default:
+			names = append(names, fmt.Sprintf("Unknown (%d)", eku))
+		}
+	}
+	for _, oid := range cert.UnknownExtKeyUsage {
+		names = append(names, oid.String())
+	}
+	return names
+}
+
+// hexBytes formats b as colon separated upper case hex, like OpenSSL.
+func hexBytes(b []byte) string {
+	parts := make([]string, len(b))
+	for i, c := range b {
+		parts[i] = fmt.Sprintf("%02X", c)
+	}
+	return strings.Join(parts, ":")
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInspectCertificates(t *testing.T) {
+	t.Log("Testing writeCertInfo() and writeCertPEM()... (expecting the chain of the server)")
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	stats := newTransferStats(0)
+	req, _ := http.NewRequest("GET", srv.URL, nil)
+	resp, err := srv.Client().Do(stats.attach(req))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	stats.gotResponse(resp)
+
+	certs := stats.peerCertificates(nil)
+	if len(certs) == 0 {
+		t.Fatal("Expected the certificates of the server")
+	}
+
+	var info bytes.Buffer
+	writeCertInfo(&info, certs, time.Now())
+	for _, s := range []string{"Certificate 0:\n", "  Subject: O=Acme Co\n", "DNS:example.com", "  SHA-256 Fingerprint: ", "  Serial Number: "} {
+		if !strings.Contains(info.String(), s) {
+			t.Errorf("Expected %q in %q", s, info.String())
+		}
+	}
+
+	var out bytes.Buffer
+	if err := writeCertPEM(&out, certs); err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(out.Bytes())
+	if block == nil || block.Type != "CERTIFICATE" {
+		t.Fatalf("Expected a PEM certificate, but got %q", out.String())
+	}
+	if cert, err := x509.ParseCertificate(block.Bytes); err != nil || !cert.Equal(certs[0]) {
+		t.Errorf("Expected the server certificate, but got %v", err)
+	}
+
+	// The certificate of httptest expires in 2084.
+	opts := Options{certExpiryDays: 30, certExpiryFail: true}
+	if err := opts.checkCertExpiry(ioutil.Discard, certs, time.Now()); err != nil {
+		t.Errorf("Expected no error, but got %s", err)
+	}
+	if err := opts.checkCertExpiry(ioutil.Discard, certs, certs[0].NotAfter.Add(-24*time.Hour)); !errors.Is(err, errCertExpiry) {
+		t.Errorf("Expected an expiry error, but got %v", err)
+	}
+
+	// --cert-info writes to stderr, leaving stdout to the body.
+	stdout := os.Stdout
+	defer func() { os.Stdout = stdout }()
+	os.Stdout, _ = os.Create(filepath.Join(t.TempDir(), "stdout"))
+	var stderr bytes.Buffer
+	(&Options{certInfo: true}).inspectCertificates(stats, nil, &stderr)
+	os.Stdout.Close()
+	if out, _ := ioutil.ReadFile(os.Stdout.Name()); len(out) != 0 {
+		t.Errorf("Expected nothing on stdout, but got %q", out)
+	}
+	if !strings.HasPrefix(stderr.String(), "Certificate 0:\n") {
+		t.Errorf("Expected the certificates on stderr, but got %q", stderr.String())
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+)
+
+// opensslCiphers maps the OpenSSL names of the cipher suites, as used by
+// cURL's --ciphers, to the TLS 1.0-1.2 suites implemented by Go.
+var opensslCiphers = map[string]uint16{
+	"ECDHE-ECDSA-AES128-GCM-SHA256": tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	"ECDHE-RSA-AES128-GCM-SHA256":   tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	"ECDHE-ECDSA-AES256-GCM-SHA384": tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	"ECDHE-RSA-AES256-GCM-SHA384":   tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	"ECDHE-ECDSA-CHACHA20-POLY1305": tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+	"ECDHE-RSA-CHACHA20-POLY1305":   tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+	"ECDHE-ECDSA-AES128-SHA256":     tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256,
+	"ECDHE-RSA-AES128-SHA256":       tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256,
+	"ECDHE-ECDSA-AES128-SHA":        tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+	"ECDHE-RSA-AES128-SHA":          tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+	"ECDHE-ECDSA-AES256-SHA":        tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+	"ECDHE-RSA-AES256-SHA":          tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+	"ECDHE-RSA-DES-CBC3-SHA":        tls.TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA,
+	"ECDHE-ECDSA-RC4-SHA":           tls.TLS_ECDHE_ECDSA_WITH_RC4_128_SHA,
+	"ECDHE-RSA-RC4-SHA":             tls.TLS_ECDHE_RSA_WITH_RC4_128_SHA,
+	"AES128-GCM-SHA256":             tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+	"AES256-GCM-SHA384":             tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+	"AES128-SHA256":                 tls.TLS_RSA_WITH_AES_128_CBC_SHA256,
+	"AES128-SHA":                    tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+	"AES256-SHA":                    tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+	"DES-CBC3-SHA":                  tls.TLS_RSA_WITH_3DES_EDE_CBC_SHA,
+	"RC4-SHA":                       tls.TLS_RSA_WITH_RC4_128_SHA,
+}
+
+// parseCiphers parses a list of cipher suites separated by colons, commas or
+// spaces. Both the OpenSSL names and the IANA names used by Go are accepted.
+func parseCiphers(list string) ([]uint16, error) {
+	iana := make(map[string]uint16)
+	for _, cs := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		iana[cs.Name] = cs.ID
+	}
+
+	var suites []uint16
+	for _, name := range splitList(list) {
+		if id, ok := opensslCiphers[strings.ToUpper(name)]; ok {
+			suites = append(suites, id)
+			continue
+		}
+		id, ok := iana[strings.ToUpper(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite %q", name)
+		}
+		for _, v := range cipherSuiteVersions(id) {
+			if v == tls.VersionTLS13 {
+				return nil, fmt.Errorf("cipher suite %q is a TLS 1.3 suite, which can't be configured", name)
+			}
+		}
+		suites = append(suites, id)
+	}
+	return suites, nil
+}
+
+// parseCurves parses a list of key exchange groups separated by colons,
+// commas or spaces, using either the NIST or the OpenSSL names.
+func parseCurves(list string) ([]tls.CurveID, error) {
+	var curves []tls.CurveID
+	for _, name := range splitList(list) {
+		switch strings.ToLower(name) {
+		case "x25519":
+			curves = append(curves, tls.X25519)
+		case "p-256", "prime256v1", "secp256r1":
+			curves = append(curves, tls.CurveP256)
+		case "p-384", "secp384r1":
+			curves = append(curves, tls.CurveP384)
+		case "p-521", "secp521r1":
+			curves = append(curves, tls.CurveP521)
+		default:
+			return nil, fmt.Errorf("unknown curve %q", name)
+		}
+	}
+	return curves, nil
+}
+
+func cipherSuiteVersions(id uint16) []uint16 {
+	for _, cs := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		if cs.ID == id {
+			return cs.SupportedVersions
+		}
+	}
+	return nil
+}
+
+func splitList(list string) []string {
+	return strings.FieldsFunc(list, func(r rune) bool {
+		return r == ':' || r == ',' || r == ' '
+	})
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"crypto/tls"
+	"testing"
+)
+
+func TestParseCiphers(t *testing.T) {
+	t.Log("Testing parseCiphers()... (expecting OpenSSL and IANA names)")
+
+	suites, err := parseCiphers("ECDHE-RSA-AES128-GCM-SHA256:TLS_RSA_WITH_AES_128_CBC_SHA, aes256-sha")
+	if err != nil {
+		t.Fatalf("parseCiphers() failed : %s", err)
+	}
+
+	expected := []uint16{
+		tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+		tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+	}
+	if len(suites) != len(expected) {
+		t.Fatalf("Expected %d suites, but got %d", len(expected), len(suites))
+	}
+	for i := range expected {
+		if suites[i] != expected[i] {
+			t.Errorf("Expected suite %#04x, but got %#04x", expected[i], suites[i])
+		}
+	}
+
+	if _, err := parseCiphers("TLS_AES_128_GCM_SHA256"); err == nil {
+		t.Error("Expected an error for a TLS 1.3 suite")
+	}
+	if _, err := parseCiphers("NOT-A-CIPHER"); err == nil {
+		t.Error("Expected an error for an unknown suite")
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// acceptEncoding is the Accept-Encoding header sent with --compressed.
+const acceptEncoding = "deflate, gzip, br, zstd"
+
+// decodeBody returns a reader decoding body according to the Content-Encoding
+// header of the response. When several encodings were applied, they are
+// undone in the reverse order.
+func decodeBody(body io.Reader, contentEncoding string) (io.ReadCloser, error) {
+	var closers []io.Closer
+	r := body
+
+	encodings := strings.Split(contentEncoding, ",")
+	for i := len(encodings) - 1; i >= 0; i-- {
+		switch enc := strings.ToLower(strings.TrimSpace(encodings[i])); enc {
+		case "", "identity":
+		case "gzip", "x-gzip":
+			zr, err := gzip.NewReader(r)
+			if err == io.EOF {
+				// An empty body, like the one of a 204 response.
+				r = strings.NewReader("")
+				continue
+			}
+			if err != nil {
+				return nil, fmt.Errorf("unable to decode the gzip response; %s", err)
+			}
+			closers = append(closers, zr)
+			r = zr
+		case "deflate":
+			// The deflate encoding is the zlib format, but some servers send
+			// raw deflate data instead.
+			br := bufio.NewReader(r)
+			if hdr, err := br.Peek(2); err == nil && isZlibHeader(hdr) {
+				zr, err := zlib.NewReader(br)
+				if err != nil {
+					return nil, fmt.Errorf("unable to decode the deflate response; %s", err)
+				}
+				closers = append(closers, zr)
+				r = zr
+			} else {
+				fr := flate.NewReader(br)
+				closers = append(closers, fr)
+				r = fr
+			}
+		case "br":
+			r = brotli.NewReader(r)
+		case "zstd":
+			zr, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+			if err != nil {
+				return nil, fmt.Errorf("unable to decode the zstd response; %s", err)
+			}
+			closers = append(closers, zr.IOReadCloser())
+			r = zr
+		default:
+			return nil, fmt.Errorf("unsupported Content-Encoding %q", enc)
+		}
+	}
+
+	if len(closers) == 0 {
+		return ioutil.NopCloser(r), nil
+	}
+	return &decodedBody{Reader: r, closers: closers}, nil
+}
+
+// isZlibHeader reports whether hdr starts a zlib stream (RFC 1950).
+func isZlibHeader(hdr []byte) bool {
+	return hdr[0]&0x0f == 8 && (uint16(hdr[0])<<8|uint16(hdr[1]))%31 == 0
+}
+
+// decodedBody closes the decoders along with the decoded body.
+type decodedBody struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (b *decodedBody) Close() error {
+	var err error
+	for _, c := range b.closers {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
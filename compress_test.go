@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestDecodeBody(t *testing.T) {
+	t.Log("Testing decodeBody()... (expecting every Content-Encoding to be undone)")
+
+	const text = "kurly decodes the compressed responses"
+
+	encode := func(enc string, data []byte) []byte {
+		var buf bytes.Buffer
+		var w io.WriteCloser
+		switch enc {
+		case "gzip":
+			w = gzip.NewWriter(&buf)
+		case "deflate":
+			w = zlib.NewWriter(&buf)
+		case "raw-deflate":
+			w, _ = flate.NewWriter(&buf, flate.DefaultCompression)
+		case "br":
+			w = brotli.NewWriter(&buf)
+		case "zstd":
+			w, _ = zstd.NewWriter(&buf)
+		}
+		w.Write(data)
+		w.Close()
+		return buf.Bytes()
+	}
+
+	tests := []struct {
+		header string
+		body   []byte
+	}{
+		{"gzip", encode("gzip", []byte(text))},
+		{"deflate", encode("deflate", []byte(text))},
+		{"deflate", encode("raw-deflate", []byte(text))},
+		{"br", encode("br", []byte(text))},
+		{"zstd", encode("zstd", []byte(text))},
+		{"gzip, br", encode("br", encode("gzip", []byte(text)))},
+		{"identity", []byte(text)},
+	}
+	for _, tt := range tests {
+		r, err := decodeBody(bytes.NewReader(tt.body), tt.header)
+		if err != nil {
+			t.Errorf("decodeBody(%q) failed : %s", tt.header, err)
+			continue
+		}
+		got, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil || string(got) != text {
+			t.Errorf("Expected %q for %q, but got %q (%v)", text, tt.header, got, err)
+		}
+	}
+
+	if _, err := decodeBody(bytes.NewReader(nil), "compress"); err == nil {
+		t.Error("Expected an error for an unsupported encoding")
+	}
+}
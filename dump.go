@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// traceLog writes the --trace and --trace-ascii dumps of the data sent and
+// received on the connections, in the format of cURL.
+type traceLog struct {
+	mu    sync.Mutex
+	w     io.Writer
+	ascii bool // --trace-ascii, the data as text rather than hex
+	times bool // --trace-time
+	conns int
+}
+
+// openTrace opens the --trace or --trace-ascii destination, "-" being
+// stdout. It returns nil when no trace is requested.
+func (o *Options) openTrace() (*traceLog, error) {
+	if o.trace != "" && o.traceASCII != "" {
+		return nil, errors.New("--trace and --trace-ascii can't be used together")
+	}
+	t := &traceLog{w: os.Stdout, times: o.traceTime}
+	file := o.trace
+	if o.traceASCII != "" {
+		file = o.traceASCII
+		t.ascii = true
+	}
+	if file == "" {
+		return nil, nil
+	}
+	if file != "-" {
+		f, err := os.Create(file)
+		if err != nil {
+			return nil, fmt.Errorf("unable to open the trace file; %s", err)
+		}
+		t.w = f
+	}
+	return t, nil
+}
+
+// Close closes the trace file, if it isn't stdout.
+func (t *traceLog) Close() error {
+	if f, ok := t.w.(*os.File); ok && f != os.Stdout {
+		return f.Close()
+	}
+	return nil
+}
+
+// newConn returns c dumping everything read and written on it to t.
+func (t *traceLog) newConn(c net.Conn) *traceConn {
+	t.mu.Lock()
+	id := t.conns
+	t.conns++
+	t.mu.Unlock()
+	t.infof("Connected to %s (#%d)", c.RemoteAddr(), id)
+	return &traceConn{Conn: c, log: t, id: id}
+}
+
+func (t *traceLog) infof(format string, args ...interface{}) {
+	var b bytes.Buffer
+	t.line(&b, time.Now())
+	fmt.Fprintf(&b, "== Info: "+format+"\n", args...)
+	t.write(b.Bytes())
+}
+
+// dump writes data, sent or received according to send, the way cURL does:
+// a line announcing it, followed by the data with its offsets.
+func (t *traceLog) dump(send bool, data []byte) {
+	now := time.Now()
+	var b bytes.Buffer
+	t.line(&b, now)
+	if send {
+		b.WriteString("=> Send data")
+	} else {
+		b.WriteString("<= Recv data")
+	}
+	fmt.Fprintf(&b, ", %d bytes (%#x)\n", len(data), len(data))
+
+	if t.ascii {
+		t.dumpASCII(&b, now, data)
+	} else {
+		t.dumpHex(&b, now, data)
+	}
+	t.write(b.Bytes())
+}
+
+// dumpHex writes data 16 bytes per line, in hex and as text.
+func (t *traceLog) dumpHex(b *bytes.Buffer, now time.Time, data []byte) {
+	const width = 16
+	for off := 0; off < len(data); off += width {
+		end := off + width
+		if end > len(data) {
+			end = len(data)
+		}
+		t.line(b, now)
+		fmt.Fprintf(b, "%04x: ", off)
+		for i := off; i < off+width; i++ {
+			if i < end {
+				fmt.Fprintf(b, "%02x ", data[i])
+			} else {
+				b.WriteString("   ")
+			}
+		}
+		for _, c := range data[off:end] {
+			b.WriteByte(printable(c))
+		}
+		b.WriteByte('\n')
+	}
+}
+
+// dumpASCII writes data as text, a line of the data being a line of the
+// dump, up to 64 bytes. The line endings aren't written.
+func (t *traceLog) dumpASCII(b *bytes.Buffer, now time.Time, data []byte) {
+	const width = 64
+	for off := 0; off < len(data); {
+		t.line(b, now)
+		fmt.Fprintf(b, "%04x: ", off)
+		i := off
+		for ; i < len(data) && i-off < width; i++ {
+			if data[i] == '\n' {
+				i++
+				break
+			}
+			if data[i] == '\r' && i+1 < len(data) && data[i+1] == '\n' {
+				i += 2
+				break
+			}
+			b.WriteByte(printable(data[i]))
+		}
+		b.WriteByte('\n')
+		off = i
+	}
+}
+
+// line starts a line of the dump, with the time when --trace-time is given.
+func (t *traceLog) line(b *bytes.Buffer, now time.Time) {
+	if t.times {
+		b.WriteString(now.Format("15:04:05.000000 "))
+	}
+}
+
+func (t *traceLog) write(p []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.w.Write(p)
+}
+
+func printable(c byte) byte {
+	if c < 0x20 || c >= 0x7f {
+		return '.'
+	}
+	return c
+}
+
+// traceConn is a connection dumping its traffic to a traceLog. Once TLS is
+// started over it, right away or through a proxy tunnel, the encrypted data
+// isn't dumped any more: the TLS connections opened by the dialer are traced
+// themselves instead, the data being dumped after the decryption.
+type traceConn struct {
+	net.Conn
+	log *traceLog
+	id  int
+
+	mu        sync.Mutex
+	written   bool // anything was written
+	tunnel    bool // the last write was a CONNECT request
+	encrypted bool
+	closed    sync.Once
+}
+
+// decrypted returns the trace of conn, the TLS connection started over the
+// connection of c, under the same number.
+func (c *traceConn) decrypted(conn net.Conn) *traceConn {
+	return &traceConn{Conn: conn, log: c.log, id: c.id, written: true}
+}
+
+func (c *traceConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 && !c.isEncrypted() {
+		c.log.dump(false, p[:n])
+	}
+	return n, err
+}
+
+func (c *traceConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	if !c.encrypted && (!c.written || c.tunnel) && isTLSHandshake(p) {
+		c.encrypted = true
+		c.log.infof("TLS handshake on connection #%d, the encrypted data isn't traced", c.id)
+	}
+	c.written = true
+	c.tunnel = bytes.HasPrefix(p, []byte("CONNECT "))
+	c.mu.Unlock()
+
+	n, err := c.Conn.Write(p)
+	if n > 0 && !c.isEncrypted() {
+		c.log.dump(true, p[:n])
+	}
+	return n, err
+}
+
+func (c *traceConn) Close() error {
+	c.closed.Do(func() { c.log.infof("Closing connection #%d", c.id) })
+	return c.Conn.Close()
+}
+
+func (c *traceConn) isEncrypted() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.encrypted
+}
+
+// isTLSHandshake reports whether p starts with a TLS handshake record.
+func isTLSHandshake(p []byte) bool {
+	return len(p) >= 3 && p[0] == 0x16 && p[1] == 0x03
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestTraceLogDump(t *testing.T) {
+	t.Log("Testing traceLog.dump()... (expecting cURL's hex and text formats)")
+
+	var buf bytes.Buffer
+	hex := &traceLog{w: &buf}
+	hex.dump(true, []byte("GET / HTTP/1.1\r\nHost: a\r\n\r\n"))
+	expected := "=> Send data, 27 bytes (0x1b)\n" +
+		"0000: 47 45 54 20 2f 20 48 54 54 50 2f 31 2e 31 0d 0a GET / HTTP/1.1..\n" +
+		"0010: 48 6f 73 74 3a 20 61 0d 0a 0d 0a                Host: a....\n"
+	if buf.String() != expected {
+		t.Errorf("Expected %q, but got %q", expected, buf.String())
+	}
+
+	buf.Reset()
+	ascii := &traceLog{w: &buf, ascii: true}
+	ascii.dump(false, []byte("HTTP/1.1 200 OK\r\nA: b\r\n\r\nhi\x01"))
+	expected = "<= Recv data, 28 bytes (0x1c)\n" +
+		"0000: HTTP/1.1 200 OK\n" +
+		"0011: A: b\n" +
+		"0017: \n" +
+		"0019: hi.\n"
+	if buf.String() != expected {
+		t.Errorf("Expected %q, but got %q", expected, buf.String())
+	}
+}
+
+func TestTraceConn(t *testing.T) {
+	t.Log("Testing --trace-ascii... (expecting the request and the chunked response)")
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+		w.(http.Flusher).Flush()
+		io.WriteString(w, "world")
+	}))
+	defer srv.Close()
+
+	file := filepath.Join(t.TempDir(), "trace.txt")
+	opts := Options{traceASCII: file, traceTime: true}
+	trace, err := opts.openTrace()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer trace.Close()
+	opts.traceLog = trace
+	tr, err := opts.newTransport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := (&http.Client{Transport: tr}).Get(srv.URL + "/path")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	data, _ := ioutil.ReadFile(file)
+	dump := string(data)
+	for _, s := range []string{"== Info: Connected to ", ": GET /path HTTP/1.1\n", ": Transfer-Encoding: chunked\n", ": 5\n", ": hello\n"} {
+		if !strings.Contains(dump, s) {
+			t.Errorf("Expected %q in the trace %q", s, dump)
+		}
+	}
+	stamp := regexp.MustCompile(`^\d\d:\d\d:\d\d\.\d{6} `)
+	for _, line := range strings.Split(strings.TrimSuffix(dump, "\n"), "\n") {
+		if !stamp.MatchString(line) {
+			t.Errorf("Expected a timestamp, but got %q", line)
+		}
+	}
+}
+
+// traceTransfer gets url with opts, tracing it as text, and returns the
+// response and the trace.
+func traceTransfer(t *testing.T, opts Options, url string) (*http.Response, string) {
+	file := filepath.Join(t.TempDir(), "trace.txt")
+	opts.traceASCII = file
+	trace, err := opts.openTrace()
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts.traceLog = trace
+	tr, err := opts.newTransport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := (&http.Client{Transport: tr}).Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	trace.Close()
+
+	data, _ := ioutil.ReadFile(file)
+	return resp, string(data)
+}
+
+// connectProxy starts an HTTP proxy which only tunnels, with CONNECT.
+func connectProxy(t *testing.T) *httptest.Server {
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "CONNECT" {
+			http.Error(w, "only CONNECT", http.StatusMethodNotAllowed)
+			return
+		}
+		target, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer target.Close()
+		conn, brw, _ := w.(http.Hijacker).Hijack()
+		defer conn.Close()
+		io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+		go io.Copy(target, brw)
+		io.Copy(conn, target)
+	}))
+	t.Cleanup(proxy.Close)
+	return proxy
+}
+
+func TestTraceTLS(t *testing.T) {
+	t.Log("Testing --trace-ascii over TLS... (expecting the decrypted HTTP/1.1 traffic, even with an HTTP/2 server)")
+
+	setProxyEnv(t, nil)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "secret body")
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	for _, opts := range []Options{{insecure: true}, {insecure: true, http2: true},
+		{insecure: true, priorKnowledge: true}, {insecure: true, http10: true}} {
+		resp, dump := traceTransfer(t, opts, srv.URL+"/path")
+		proto := "HTTP/1.1"
+		if opts.http10 {
+			proto = "HTTP/1.0"
+		}
+		for _, s := range []string{": GET /path " + proto + "\n", ": secret body\n"} {
+			if !strings.Contains(dump, s) {
+				t.Errorf("Expected %q in the trace %q", s, dump)
+			}
+		}
+		if strings.Contains(dump, "isn't traced") || resp.ProtoMajor != 1 {
+			t.Errorf("Expected the whole %s traffic to be traced, but got %q", resp.Proto, dump)
+		}
+	}
+}
+
+func TestTraceProxyTunnel(t *testing.T) {
+	t.Log("Testing --trace-ascii through a proxy tunnel... (expecting the CONNECT and the decrypted traffic)")
+
+	setProxyEnv(t, nil)
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "tunneled body")
+	}))
+	defer srv.Close()
+	proxy := connectProxy(t)
+
+	for _, opts := range []Options{{insecure: true, proxy: proxy.URL}, {insecure: true, proxy: proxy.URL, http10: true}} {
+		resp, dump := traceTransfer(t, opts, srv.URL+"/tunneled")
+		host := strings.TrimPrefix(srv.URL, "https://")
+		for _, s := range []string{": CONNECT " + host + " HTTP/1.1\n", ": HTTP/1.1 200 Connection established\n",
+			": GET /tunneled HTTP/1.", ": tunneled body\n"} {
+			if !strings.Contains(dump, s) {
+				t.Errorf("Expected %q in the trace %q", s, dump)
+			}
+		}
+		if strings.Contains(dump, "(#1)") || resp.StatusCode != http.StatusOK {
+			t.Errorf("Expected a single connection, but got %q", dump)
+		}
+	}
+
+	// A tunnel refused by the proxy.
+	opts := Options{insecure: true, proxy: proxy.URL, include: true}
+	tr, err := opts.newTransport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = (&http.Client{Transport: tr}).Get("https://127.0.0.1:1/")
+	if classifyError(err) != "proxy" {
+		t.Errorf("Expected a proxy error, but got %v", err)
+	}
+}
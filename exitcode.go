@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// The exit codes of kurly, the ones of cURL for the same failures.
+const (
+	exitUnsupportedProtocol = 1
+	exitURLMalformed        = 3
+	exitResolveProxy        = 5
+	exitResolveHost         = 6
+	exitConnect             = 7
+	exitWeirdServerReply    = 8
+	exitHTTP2               = 16
+	exitHTTPError           = 22 // with --fail and --fail-with-body
+	exitWriteError          = 23
+	exitReadError           = 26 // reading a local file
+	exitTimeout             = 28
+	exitRangeError          = 33
+	exitTLSConnect          = 35
+	exitTooManyRedirects    = 47
+	exitRecvError           = 56
+	exitPeerVerification    = 60 // also with --cert-expiry-fail
+	exitBadContentEncoding  = 61
+	exitPinnedPubKey        = 90
+	exitCertStatus          = 91
+	exitProxy               = 97
+
+	// used by kurly for the failures cURL has no code for
+	exitOther = 1
+)
+
+// exitError is a failure for which kurly exits with the given code.
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string { return e.err.Error() }
+func (e *exitError) Unwrap() error { return e.err }
+
+// withExitCode returns err with the exit code for it, unless it already has
+// one.
+func withExitCode(code int, err error) error {
+	var exitErr *exitError
+	if errors.As(err, &exitErr) {
+		return err
+	}
+	return &exitError{code: code, err: err}
+}
+
+// errReported is the failure of transfers whose errors were already
+// reported.
+var errReported = errors.New("transfer failed")
+
+// errTooManyRedirects is returned when -L would follow more redirects than
+// --max-redirs.
+var errTooManyRedirects = errors.New("maximum redirects followed")
+
+// httpStatusError returns the error of a response failing the transfer with
+// --fail or --fail-with-body.
+func httpStatusError(status int) error {
+	return &exitError{code: exitHTTPError, err: fmt.Errorf("The requested URL returned error: %d", status)}
+}
+
+// exitCodeFor returns the exit code for the error of a transfer.
+func exitCodeFor(err error) int {
+	var exitErr *exitError
+	switch {
+	case err == nil:
+		return 0
+	case errors.As(err, &exitErr):
+		return exitErr.code
+	case errors.Is(err, errPinnedPubKey):
+		return exitPinnedPubKey
+	case errors.Is(err, errCertStatus):
+		return exitCertStatus
+	case errors.Is(err, errCertExpiry):
+		return exitPeerVerification
+	case errors.Is(err, errTooManyRedirects):
+		return exitTooManyRedirects
+	}
+
+	var opErr *net.OpError
+	var socksErr *socksError
+	switch classifyError(err) {
+	case "dns":
+		if errors.As(err, &opErr) && opErr.Op == "proxyconnect" || errors.As(err, &socksErr) {
+			return exitResolveProxy
+		}
+		return exitResolveHost
+	case "connect":
+		return exitConnect
+	case "proxy":
+		return exitProxy
+	case "timeout":
+		return exitTimeout
+	case "tls":
+		return exitTLSConnect
+	case "tls_verify":
+		return exitPeerVerification
+	case "url":
+		if strings.Contains(err.Error(), "unsupported protocol scheme") {
+			return exitUnsupportedProtocol
+		}
+		return exitURLMalformed
+	case "http":
+		if strings.Contains(err.Error(), "http2:") {
+			return exitHTTP2
+		}
+		return exitWeirdServerReply
+	}
+	return exitOther
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestExitCodeFor(t *testing.T) {
+	t.Log("Testing exitCodeFor()... (expecting cURL's exit codes)")
+
+	for _, c := range []struct {
+		err  error
+		code int
+	}{
+		{nil, 0},
+		{&url.Error{Op: "Get", URL: "http://nx", Err: &net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", Name: "nx"}}}, exitResolveHost},
+		{&url.Error{Op: "Get", URL: "http://nx", Err: &net.OpError{Op: "proxyconnect", Err: &net.DNSError{Err: "no such host", Name: "proxy"}}}, exitResolveProxy},
+		{&url.Error{Op: "Get", URL: "http://a", Err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}}, exitConnect},
+		{&url.Error{Op: "Get", URL: "http://a", Err: &socksError{"SOCKS4", "1.2.3.4:80", errors.New("request rejected by the proxy (code 91)")}}, exitProxy},
+		{&url.Error{Op: "Get", URL: "http://a", Err: &socksError{"SOCKS5", "a:80", &net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", Name: "proxy"}}}}, exitResolveProxy},
+		{&url.Error{Op: "Get", URL: "http://a", Err: context.DeadlineExceeded}, exitTimeout},
+		{&url.Error{Op: "Get", URL: "http://a", Err: fmt.Errorf("%w (10)", errTooManyRedirects)}, exitTooManyRedirects},
+		{&url.Error{Op: "Get", URL: "ftp://a", Err: errors.New("unsupported protocol scheme \"ftp\"")}, exitUnsupportedProtocol},
+		{httpStatusError(404), exitHTTPError},
+		{fmt.Errorf("failed to copy URL content; %w", withExitCode(exitWriteError, errors.New("broken pipe"))), exitWriteError},
+		{withExitCode(exitRecvError, withExitCode(exitWriteError, errors.New("disk full"))), exitWriteError},
+		{fmt.Errorf("wrapped: %w", errPinnedPubKey), exitPinnedPubKey},
+		{fmt.Errorf("%w; CN=a expires in 2 days", errCertExpiry), exitPeerVerification},
+		{errors.New("something else"), exitOther},
+	} {
+		if code := exitCodeFor(c.err); code != c.code {
+			t.Errorf("Expected exit code %d for %v, but got %d", c.code, c.err, code)
+		}
+	}
+}
+
+func TestCheckRedirect(t *testing.T) {
+	t.Log("Testing checkRedirect()... (expecting an error past --max-redirs)")
+
+	opts := Options{followRedirect: true, maxRedirects: 2}
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	for i := 1; i <= 2; i++ {
+		if err := opts.checkRedirect(req, nil); err != nil {
+			t.Fatalf("Expected redirect %d to be followed, but got %s", i, err)
+		}
+	}
+	if err := opts.checkRedirect(req, nil); !errors.Is(err, errTooManyRedirects) {
+		t.Errorf("Expected the third redirect to fail, but got %v", err)
+	}
+
+	opts = Options{maxRedirects: 2}
+	if err := opts.checkRedirect(req, nil); err != http.ErrUseLastResponse {
+		t.Errorf("Expected the redirect not to be followed without -L, but got %v", err)
+	}
+}
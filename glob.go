@@ -0,0 +1,241 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// maxGlobURLs is the most URLs a single URL pattern may expand to.
+const maxGlobURLs = 100000
+
+// globbedURL is one of the URLs a URL pattern expands to, with the values
+// taken by each of its globs, for the #N of -o.
+type globbedURL struct {
+	url    string
+	values []string
+}
+
+// globSegment is a piece of a URL pattern, either literal text or a glob,
+// one of whose alternatives is taken by each URL.
+type globSegment struct {
+	alts []string
+	glob bool
+}
+
+// expandURLs expands the URL patterns of the command line, unless
+// -g, --globoff is given.
+func (o *Options) expandURLs(args []string) ([]globbedURL, error) {
+	var urls []globbedURL
+	for _, arg := range args {
+		if o.globOff {
+			urls = append(urls, globbedURL{url: arg})
+			continue
+		}
+		expanded, err := expandGlob(arg)
+		if err != nil {
+			return nil, withExitCode(exitURLMalformed, fmt.Errorf("unable to expand the URL %s; %w", arg, err))
+		}
+		urls = append(urls, expanded...)
+	}
+	return urls, nil
+}
+
+// expandGlob expands the {a,b,c} sets and the [1-10], [001-100:5] and [a-z]
+// ranges of pattern, the first glob varying the slowest. A backslash escapes
+// the next brace, bracket or comma, and the brackets of an IPv6 address are
+// kept as is.
+func expandGlob(pattern string) ([]globbedURL, error) {
+	segments, err := parseGlob(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	total := 1
+	for _, seg := range segments {
+		total *= len(seg.alts)
+		if total > maxGlobURLs {
+			return nil, fmt.Errorf("the pattern expands to more than %d URLs", maxGlobURLs)
+		}
+	}
+
+	urls := []globbedURL{{}}
+	for _, seg := range segments {
+		next := make([]globbedURL, 0, len(urls)*len(seg.alts))
+		for _, u := range urls {
+			for _, alt := range seg.alts {
+				g := globbedURL{url: u.url + alt, values: u.values}
+				if seg.glob {
+					g.values = append(u.values[:len(u.values):len(u.values)], alt)
+				}
+				next = append(next, g)
+			}
+		}
+		urls = next
+	}
+	return urls, nil
+}
+
+func parseGlob(pattern string) ([]globSegment, error) {
+	var segments []globSegment
+	var lit strings.Builder
+	flush := func() {
+		if lit.Len() > 0 {
+			segments = append(segments, globSegment{alts: []string{lit.String()}})
+			lit.Reset()
+		}
+	}
+
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch c {
+		case '\\':
+			if i+1 < len(pattern) && strings.IndexByte("{}[],", pattern[i+1]) >= 0 {
+				i++
+				c = pattern[i]
+			}
+			lit.WriteByte(c)
+		case '{':
+			end := strings.IndexByte(pattern[i:], '}')
+			if end < 0 {
+				return nil, fmt.Errorf("unmatched brace at position %d", i+1)
+			}
+			body := pattern[i+1 : i+end]
+			if strings.IndexByte(body, '{') >= 0 {
+				return nil, fmt.Errorf("nested braces at position %d", i+1)
+			}
+			flush()
+			segments = append(segments, globSegment{alts: splitGlobSet(body), glob: true})
+			i += end
+		case '[':
+			end := strings.IndexByte(pattern[i:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unmatched bracket at position %d", i+1)
+			}
+			body := pattern[i+1 : i+end]
+			if isIPv6Literal(body) {
+				lit.WriteString(pattern[i : i+end+1])
+				i += end
+				continue
+			}
+			alts, err := globRange(body)
+			if err != nil {
+				return nil, fmt.Errorf("bad range at position %d; %w", i+1, err)
+			}
+			flush()
+			segments = append(segments, globSegment{alts: alts, glob: true})
+			i += end
+		case '}', ']':
+			return nil, fmt.Errorf("unmatched close %q at position %d", c, i+1)
+		default:
+			lit.WriteByte(c)
+		}
+	}
+	flush()
+	return segments, nil
+}
+
+// splitGlobSet splits the alternatives of a {a,b,c} set, a backslash
+// escaping a comma.
+func splitGlobSet(body string) []string {
+	var alts []string
+	var alt strings.Builder
+	for i := 0; i < len(body); i++ {
+		switch {
+		case body[i] == '\\' && i+1 < len(body) && body[i+1] == ',':
+			alt.WriteByte(',')
+			i++
+		case body[i] == ',':
+			alts = append(alts, alt.String())
+			alt.Reset()
+		default:
+			alt.WriteByte(body[i])
+		}
+	}
+	return append(alts, alt.String())
+}
+
+var errGlobRange = errors.New("expected [start-end] or [start-end:step], with numbers or letters")
+
+// globRange expands a [1-10], [001-100:5] or [a-z:2] range. A start with
+// leading zeros sets the width of the numbers.
+func globRange(body string) ([]string, error) {
+	step := 1
+	if i := strings.LastIndexByte(body, ':'); i >= 0 {
+		var err error
+		if step, err = strconv.Atoi(body[i+1:]); err != nil || step < 1 {
+			return nil, errGlobRange
+		}
+		body = body[:i]
+	}
+	bounds := strings.SplitN(body, "-", 2)
+	if len(bounds) != 2 || bounds[0] == "" || bounds[1] == "" {
+		return nil, errGlobRange
+	}
+	from, to := bounds[0], bounds[1]
+
+	if len(from) == 1 && len(to) == 1 && isLetter(from[0]) && isLetter(to[0]) {
+		if from[0] > to[0] || isLower(from[0]) != isLower(to[0]) {
+			return nil, errGlobRange
+		}
+		var alts []string
+		for c := int(from[0]); c <= int(to[0]); c += step {
+			alts = append(alts, string(rune(c)))
+		}
+		return alts, nil
+	}
+
+	start, err1 := strconv.Atoi(from)
+	end, err2 := strconv.Atoi(to)
+	if err1 != nil || err2 != nil || start < 0 || start > end {
+		return nil, errGlobRange
+	}
+	if (end-start)/step >= maxGlobURLs {
+		return nil, fmt.Errorf("the range expands to more than %d URLs", maxGlobURLs)
+	}
+	width := 0
+	if len(from) > 1 && from[0] == '0' {
+		width = len(from)
+	}
+	var alts []string
+	for n := start; n <= end; n += step {
+		alts = append(alts, fmt.Sprintf("%0*d", width, n))
+	}
+	return alts, nil
+}
+
+func isLetter(c byte) bool { return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' }
+func isLower(c byte) bool  { return 'a' <= c && c <= 'z' }
+
+// isIPv6Literal reports whether the content of brackets is an IPv6 address,
+// possibly with a zone, rather than a range.
+func isIPv6Literal(body string) bool {
+	addr := strings.SplitN(body, "%", 2)[0]
+	return strings.Contains(addr, ":") && net.ParseIP(addr) != nil
+}
+
+// expandOutput replaces the #N of the -o file name with the value taken by
+// the Nth glob of the URL.
+func expandOutput(name string, values []string) string {
+	if len(values) == 0 || !strings.Contains(name, "#") {
+		return name
+	}
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		if name[i] == '#' {
+			j := i + 1
+			for j < len(name) && '0' <= name[j] && name[j] <= '9' {
+				j++
+			}
+			if n, err := strconv.Atoi(name[i+1 : j]); err == nil && n >= 1 && n <= len(values) {
+				b.WriteString(values[n-1])
+				i = j - 1
+				continue
+			}
+		}
+		b.WriteByte(name[i])
+	}
+	return b.String()
+}
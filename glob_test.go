@@ -0,0 +1,57 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExpandGlob(t *testing.T) {
+	t.Log("Testing expandGlob()... (expecting cURL's URL globbing)")
+
+	for pattern, expected := range map[string][]string{
+		"http://example.com/":               {"http://example.com/"},
+		"http://{a,b}.example.com/":         {"http://a.example.com/", "http://b.example.com/"},
+		"http://h/log[08-10].txt":           {"http://h/log08.txt", "http://h/log09.txt", "http://h/log10.txt"},
+		"http://h/[1-10:4]":                 {"http://h/1", "http://h/5", "http://h/9"},
+		"http://h/[a-c]":                    {"http://h/a", "http://h/b", "http://h/c"},
+		"http://{x,y}/[1-2]":                {"http://x/1", "http://x/2", "http://y/1", "http://y/2"},
+		"http://h/\\{a,b\\}":                {"http://h/{a,b}"},
+		"http://h/{a\\,b,c}":                {"http://h/a,b", "http://h/c"},
+		"http://[::1]:8080/{a,b}":           {"http://[::1]:8080/a", "http://[::1]:8080/b"},
+		"http://[fe80::1%25eth0]/[001-002]": {"http://[fe80::1%25eth0]/001", "http://[fe80::1%25eth0]/002"},
+	} {
+		urls, err := expandGlob(pattern)
+		if err != nil {
+			t.Errorf("Expected %s to expand, but got %s", pattern, err)
+			continue
+		}
+		var got []string
+		for _, u := range urls {
+			got = append(got, u.url)
+		}
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("Expected %v for %s, but got %v", expected, pattern, got)
+		}
+	}
+
+	for _, pattern := range []string{"http://h/{a,b", "http://h/[1-", "http://h/]", "http://h/[5-1]", "http://h/[a-Z]", "http://h/[1-9:0]", "http://h/{a,{b}}"} {
+		if _, err := expandGlob(pattern); err == nil {
+			t.Errorf("Expected an error for %s", pattern)
+		}
+	}
+}
+
+func TestExpandOutput(t *testing.T) {
+	t.Log("Testing expandOutput()... (expecting #N replaced with the value of the Nth glob)")
+
+	urls, _ := expandGlob("http://{eu,us}.example.com/shard[1-2]")
+	expected := []string{"eu-1.log", "eu-2.log", "us-1.log", "us-2.log"}
+	for i, u := range urls {
+		if got := expandOutput("#1-#2.log", u.values); got != expected[i] {
+			t.Errorf("Expected %s for %s, but got %s", expected[i], u.url, got)
+		}
+	}
+	if got := expandOutput("#3#x#", []string{"a"}); got != "#3#x#" {
+		t.Errorf("Expected #3#x# to be kept, but got %s", got)
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"time"
+	"unicode/utf8"
+)
+
+// harLog is an HTTP Archive (HAR 1.2) log of the requests of every transfer
+// of the invocation, written with --har.
+type harLog struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Entries []harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime time.Time   `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	ServerIPAddress string      `json:"serverIPAddress,omitempty"`
+	Connection      string      `json:"connection,omitempty"`
+	Error           string      `json:"_error,omitempty"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harCookie    `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int64          `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harCookie    `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int64          `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harCookie struct {
+	Name     string     `json:"name"`
+	Value    string     `json:"value"`
+	Path     string     `json:"path,omitempty"`
+	Domain   string     `json:"domain,omitempty"`
+	Expires  *time.Time `json:"expires,omitempty"`
+	HTTPOnly bool       `json:"httpOnly,omitempty"`
+	Secure   bool       `json:"secure,omitempty"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type harContent struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+// harTimings are in milliseconds, -1 for the phases which didn't happen.
+type harTimings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	SSL     float64 `json:"ssl"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+func newHARLog() *harLog {
+	return &harLog{
+		Version: "1.2",
+		Creator: harCreator{Name: "kurly", Version: version},
+		Entries: []harEntry{},
+	}
+}
+
+// add appends an entry for every request of the transfer.
+func (l *harLog) add(s *transferStats) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, h := range s.hops {
+		last := i == len(s.hops)-1
+		e := harEntry{
+			StartedDateTime: h.start,
+			Time:            ms(h.end.Sub(h.start)),
+			Request:         newHARRequest(h.req),
+			Response:        newHARResponse(h.resp),
+			Timings:         h.harTimings(),
+		}
+		if h.resp != nil {
+			e.Request.HTTPVersion = e.Response.HTTPVersion
+		}
+		if h.remoteAddr != "" {
+			e.ServerIPAddress, _ = splitAddr(h.remoteAddr)
+		}
+		if h.localAddr != "" {
+			_, e.Connection = splitAddr(h.localAddr)
+		}
+
+		if body := s.reqBody; body != nil && i == 0 && body.total > 0 {
+			e.Request.PostData = &harPostData{
+				MimeType: h.req.Header.Get("Content-Type"),
+				Text:     body.String(),
+				Comment:  truncatedComment(body),
+			}
+		}
+		if i == 0 && s.uploaded > 0 {
+			e.Request.BodySize = s.uploaded
+		}
+
+		if last {
+			if s.err != nil {
+				e.Error = s.err.Error()
+			}
+			if h.resp != nil {
+				e.Response.BodySize = s.downloaded
+				if body := s.respBody; body != nil {
+					e.Response.Content.Size = body.total
+					e.Response.Content.Comment = truncatedComment(body)
+					if utf8.Valid(body.Bytes()) {
+						e.Response.Content.Text = body.String()
+					} else {
+						e.Response.Content.Text = base64.StdEncoding.EncodeToString(body.Bytes())
+						e.Response.Content.Encoding = "base64"
+					}
+				}
+			}
+		}
+		l.Entries = append(l.Entries, e)
+	}
+}
+
+// save writes the log to file, replacing its previous content.
+func (l *harLog) save(file string) error {
+	data, err := json.MarshalIndent(struct {
+		Log *harLog `json:"log"`
+	}{l}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(file, append(data, '\n'), 0666); err != nil {
+		return fmt.Errorf("unable to write the HAR file; %s", err)
+	}
+	return nil
+}
+
+// newHARRequest returns the HAR request of req. As in the JSON report, the
+// credentials are redacted, the HAR files being made to be shared.
+func newHARRequest(req *http.Request) harRequest {
+	r := harRequest{
+		Method:      req.Method,
+		URL:         req.URL.String(),
+		HTTPVersion: "HTTP/1.1",
+		Cookies:     []harCookie{},
+		Headers:     harHeaders(redactHeaders(req.Header)),
+		QueryString: []harNameValue{},
+		HeadersSize: requestHeaderSize(req),
+		BodySize:    req.ContentLength,
+	}
+	for _, c := range req.Cookies() {
+		r.Cookies = append(r.Cookies, harCookie{Name: c.Name, Value: "<redacted>"})
+	}
+	for k, vs := range req.URL.Query() {
+		for _, v := range vs {
+			r.QueryString = append(r.QueryString, harNameValue{Name: k, Value: v})
+		}
+	}
+	return r
+}
+
+// newHARResponse returns the HAR response of resp, or an empty one with a
+// zero status when no response was received.
+func newHARResponse(resp *http.Response) harResponse {
+	r := harResponse{
+		Cookies:  []harCookie{},
+		Headers:  []harNameValue{},
+		BodySize: -1,
+		Content:  harContent{Size: -1},
+	}
+	if resp == nil {
+		return r
+	}
+
+	r.Status = resp.StatusCode
+	r.StatusText = http.StatusText(resp.StatusCode)
+	r.HTTPVersion = protoName(resp)
+	r.Headers = harHeaders(resp.Header)
+	r.HeadersSize = responseHeaderSize(resp)
+	r.BodySize = resp.ContentLength
+	r.Content = harContent{Size: resp.ContentLength, MimeType: resp.Header.Get("Content-Type")}
+	if loc, err := resp.Location(); err == nil {
+		r.RedirectURL = loc.String()
+	}
+	for _, c := range resp.Cookies() {
+		hc := harCookie{
+			Name:     c.Name,
+			Value:    c.Value,
+			Path:     c.Path,
+			Domain:   c.Domain,
+			HTTPOnly: c.HttpOnly,
+			Secure:   c.Secure,
+		}
+		if !c.Expires.IsZero() {
+			expires := c.Expires
+			hc.Expires = &expires
+		}
+		r.Cookies = append(r.Cookies, hc)
+	}
+	return r
+}
+
+func harHeaders(header http.Header) []harNameValue {
+	keys := make([]string, 0, len(header))
+	for k := range header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	headers := []harNameValue{}
+	for _, k := range keys {
+		for _, v := range header[k] {
+			headers = append(headers, harNameValue{Name: k, Value: v})
+		}
+	}
+	return headers
+}
+
+// harTimings splits the time of the hop into the HAR phases.
+func (h *hopStats) harTimings() harTimings {
+	t := harTimings{Blocked: -1, DNS: -1, Connect: -1, SSL: -1, Send: -1, Wait: -1, Receive: -1}
+	between := func(from, to time.Time) float64 {
+		if from.IsZero() || to.IsZero() || to.Before(from) {
+			return -1
+		}
+		return ms(to.Sub(from))
+	}
+
+	// The first event after the start of the hop ends the blocked time.
+	for _, first := range []time.Time{h.dnsStart, h.connStart, h.gotConn} {
+		if !first.IsZero() {
+			t.Blocked = between(h.start, first)
+			break
+		}
+	}
+	t.DNS = between(h.dnsStart, h.dnsDone)
+	t.SSL = between(h.tlsStart, h.tlsDone)
+	// As required by HAR, the connect time includes the TLS handshake.
+	if t.SSL >= 0 {
+		t.Connect = between(h.connStart, h.tlsDone)
+	} else {
+		t.Connect = between(h.connStart, h.connDone)
+	}
+	t.Send = between(h.gotConn, h.wroteReq)
+	t.Wait = between(h.wroteReq, h.firstByte)
+	t.Receive = between(h.firstByte, h.end)
+	// The send, wait and receive times are required.
+	for _, v := range []*float64{&t.Send, &t.Wait, &t.Receive} {
+		if *v < 0 {
+			*v = 0
+		}
+	}
+	return t
+}
+
+func truncatedComment(b *cappedBuffer) string {
+	if b.total > int64(b.Len()) {
+		return fmt.Sprintf("truncated to %d of %d bytes", b.Len(), b.total)
+	}
+	return ""
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
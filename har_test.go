@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHARLog(t *testing.T) {
+	t.Log("Testing harLog... (expecting an entry per request, redirects included)")
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/old" {
+			http.Redirect(w, r, "/new", http.StatusFound)
+			return
+		}
+		io.WriteString(w, "0123456789")
+	}))
+	defer srv.Close()
+
+	c := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		statsFromContext(req.Context()).redirect(req)
+		return nil
+	}}
+	har := newHARLog()
+	for i, url := range []string{srv.URL + "/old", srv.URL + "/other?q=1"} {
+		stats := newTransferStats(i)
+		stats.captureBodies(4)
+		req, _ := http.NewRequest("GET", url, nil)
+		resp, err := c.Do(stats.attach(req))
+		if err != nil {
+			t.Fatal(err)
+		}
+		stats.gotResponse(resp)
+		io.Copy(stats.respBody, &countingReader{resp.Body, &stats.downloaded})
+		resp.Body.Close()
+		stats.finish(nil)
+		har.add(stats)
+	}
+
+	file := filepath.Join(t.TempDir(), "kurly.har")
+	if err := har.save(file); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadFile(file)
+	var doc struct {
+		Log harLog `json:"log"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		t.Fatalf("Invalid HAR file : %s", err)
+	}
+
+	entries := doc.Log.Entries
+	if doc.Log.Version != "1.2" || len(entries) != 3 {
+		t.Fatalf("Expected 3 entries in a HAR 1.2 log, but got %d in %q", len(entries), doc.Log.Version)
+	}
+	if e := entries[0]; e.Response.Status != 302 || !strings.HasSuffix(e.Response.RedirectURL, "/new") {
+		t.Errorf("Expected the redirect first, but got %+v", e.Response)
+	}
+	if e := entries[1]; e.Response.Status != 200 || e.Response.Content.Text != "0123" || e.Response.Content.Size != 10 || e.Response.Content.Comment == "" {
+		t.Errorf("Expected the truncated body, but got %+v", e.Response.Content)
+	}
+	if e := entries[2]; len(e.Request.QueryString) != 1 || e.Timings.Wait < 0 || e.ServerIPAddress != "127.0.0.1" {
+		t.Errorf("Unexpected last entry %+v", e)
+	}
+}
+
+func TestHARRedaction(t *testing.T) {
+	t.Log("Testing newHARRequest()... (expecting the credentials to be redacted)")
+
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	req.Header.Set("Authorization", "Basic Ym9iOnNlY3JldA==")
+	req.Header.Set("Proxy-Authorization", "Basic c2VjcmV0")
+	req.Header.Set("Cookie", "session=secret; other=secret")
+	req.Header.Set("Accept", "*/*")
+
+	r := newHARRequest(req)
+	for _, h := range r.Headers {
+		if h.Name != "Accept" && h.Value != "<redacted>" || h.Name == "Accept" && h.Value != "*/*" {
+			t.Errorf("Unexpected header %s: %s", h.Name, h.Value)
+		}
+	}
+	if len(r.Cookies) != 2 {
+		t.Fatalf("Expected the 2 cookies, but got %v", r.Cookies)
+	}
+	for _, c := range r.Cookies {
+		if c.Value != "<redacted>" {
+			t.Errorf("Expected the cookie %s to be redacted, but got %q", c.Name, c.Value)
+		}
+	}
+	if data, _ := json.Marshal(r); strings.Contains(string(data), "secret") || strings.Contains(string(data), "Ym9i") {
+		t.Errorf("Expected no credentials in %s", data)
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// quicFallbackTimeout is how long the QUIC handshake may take before falling
+// back to TCP with --http3.
+const quicFallbackTimeout = 2 * time.Second
+
+// h3Transport sends the https:// requests over HTTP/3 when asked to with
+// --http3 or --http3-only, or when the origin advertised an HTTP/3
+// alternative service cached in the --alt-svc file. The other requests, and
+// the ones for which QUIC fails unless --http3-only is given, go through next.
+type h3Transport struct {
+	next   http.RoundTripper // nil with --http3-only
+	h3     *http3.RoundTripper
+	d      *dialer
+	altSvc *altSvcCache // nil without --alt-svc
+	always bool         // try HTTP/3 first for every https:// URL
+
+	broken sync.Map // origins for which QUIC failed, not tried again
+}
+
+// http3Transport wraps next with the HTTP/3 support, when one of the HTTP/3
+// options is given.
+func (o *Options) http3Transport(next http.RoundTripper, tlsConfig *tls.Config, d *dialer) (http.RoundTripper, error) {
+	if !o.http3 && !o.http3Only && o.altSvc == "" {
+		return next, nil
+	}
+
+	t := &h3Transport{
+		next:   next,
+		d:      d,
+		always: o.http3 || o.http3Only,
+	}
+	if o.http3Only {
+		t.next = nil
+	}
+	if o.altSvc != "" {
+		var err error
+		if t.altSvc, err = loadAltSvc(o.altSvc); err != nil {
+			return nil, err
+		}
+	}
+
+	cfg := tlsConfig.Clone()
+	cfg.NextProtos = nil
+	t.h3 = &http3.RoundTripper{
+		TLSClientConfig:    cfg,
+		Dial:               t.dial,
+		DisableCompression: o.raw,
+	}
+	if t.next != nil {
+		// Don't wait for the default 5 seconds before falling back to TCP.
+		t.h3.QuicConfig = &quic.Config{HandshakeIdleTimeout: quicFallbackTimeout}
+	}
+	return t, nil
+}
+
+func (t *h3Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !t.useQUIC(req) {
+		return t.roundTripTCP(req)
+	}
+
+	resp, err := t.h3.RoundTrip(req)
+	if err == nil {
+		// The HTTP/3 client doesn't report its progress, the hooks are
+		// called once the response headers are received.
+		if trace := httptrace.ContextClientTrace(req.Context()); trace != nil {
+			if ts := tracerFromContext(req.Context()); ts != nil {
+				ts.proto = "HTTP/3"
+			}
+			if trace.WroteHeaders != nil {
+				trace.WroteHeaders()
+			}
+			if trace.GotFirstResponseByte != nil {
+				trace.GotFirstResponseByte()
+			}
+		}
+		t.updateAltSvc(req, resp)
+		return resp, nil
+	}
+	if t.next == nil || req.Context().Err() != nil {
+		return nil, err
+	}
+
+	// The request body may already be partly sent, it has to be rewound
+	// before trying again over TCP.
+	if req.Body != nil && req.Body != http.NoBody {
+		body, berr := req.GetBody()
+		if berr != nil {
+			return nil, err
+		}
+		req = req.Clone(req.Context())
+		req.Body = body
+	}
+	t.broken.Store(canonicalAddr(req.URL), true)
+	if t.d.verbose {
+		Status.Printf(" QUIC connection failed: %s; falling back to TCP\n", err)
+	}
+	return t.roundTripTCP(req)
+}
+
+func (t *h3Transport) roundTripTCP(req *http.Request) (*http.Response, error) {
+	if t.next == nil {
+		return nil, fmt.Errorf("unable to use HTTP/3 for %s", req.URL)
+	}
+	resp, err := t.next.RoundTrip(req)
+	if err == nil {
+		t.updateAltSvc(req, resp)
+	}
+	return resp, err
+}
+
+// useQUIC reports whether req should be tried over HTTP/3. QUIC can't go
+// through the proxies, nor through a Unix domain socket. The requests whose
+// body can't be sent again, like the -T uploads, go over TCP unless there is
+// no fallback.
+func (t *h3Transport) useQUIC(req *http.Request) bool {
+	if req.URL.Scheme != "https" || t.d.unixSocket != "" {
+		return false
+	}
+	if t.next != nil && req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return false
+	}
+	addr := canonicalAddr(req.URL)
+	if _, ok := t.broken.Load(addr); ok {
+		return false
+	}
+	if t.d.router.route(req.URL) != nil {
+		return false
+	}
+	if t.always {
+		return true
+	}
+	_, ok := t.altSvc.lookup(addr)
+	return ok
+}
+
+// updateAltSvc records the alternative services advertised by resp.
+func (t *h3Transport) updateAltSvc(req *http.Request, resp *http.Response) {
+	header := resp.Header.Get("Alt-Svc")
+	if t.altSvc == nil || header == "" || req.URL.Scheme != "https" {
+		return
+	}
+	if err := t.altSvc.update(canonicalAddr(req.URL), protoName(resp), header); err != nil {
+		Status.Printf(" %s\n", err)
+	}
+}
+
+// dial opens the QUIC connection to the origin addr, or to its cached
+// alternative service, applying the --connect-to and --resolve overrides.
+func (t *h3Transport) dial(ctx context.Context, addr string, tlsCfg *tls.Config, cfg *quic.Config) (quic.EarlyConnection, error) {
+	if alt, ok := t.altSvc.lookup(addr); ok && alt != addr {
+		if t.d.verbose {
+			Status.Printf(" Alt-svc connecting to %s\n", alt)
+		}
+		addr = alt
+	}
+	if to := t.d.overrides.redirect(addr); to != addr {
+		if t.d.verbose {
+			Status.Printf(" Connecting to hostname: %s\n", to)
+		}
+		addr = to
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ts := tracerFromContext(ctx)
+	if ts != nil {
+		ts.currentHost = host
+	}
+
+	ips := t.d.overrides.lookup(addr)
+	if len(ips) > 0 {
+		if t.d.verbose {
+			Status.Printf(" Hostname %s was found in DNS cache\n", host)
+		}
+	} else if ips, err = net.DefaultResolver.LookupHost(ctx, host); err != nil {
+		return nil, err
+	}
+
+	trace := httptrace.ContextClientTrace(ctx)
+	var conn quic.EarlyConnection
+	for _, ip := range ips {
+		a := net.JoinHostPort(ip, port)
+		if trace != nil && trace.ConnectStart != nil {
+			trace.ConnectStart("udp", a)
+		}
+		conn, err = dialQUIC(ctx, a, tlsCfg, cfg)
+		if trace != nil && trace.ConnectDone != nil {
+			trace.ConnectDone("udp", a, err)
+		}
+		if err == nil {
+			if ts != nil {
+				ts.QUICHandshakeDone(conn.ConnectionState())
+			}
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// dialQUIC connects to addr and waits for the end of the handshake, so the
+// connection state is complete.
+func dialQUIC(ctx context.Context, addr string, tlsCfg *tls.Config, cfg *quic.Config) (quic.EarlyConnection, error) {
+	conn, err := quic.DialAddrEarly(ctx, addr, tlsCfg, cfg)
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case <-conn.HandshakeComplete():
+		return conn, nil
+	case <-conn.Context().Done():
+		return nil, context.Cause(conn.Context())
+	case <-ctx.Done():
+		conn.CloseWithError(0, "")
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// startHTTP3Server starts an HTTPS server over TCP and an HTTP/3 server on
+// the same port over UDP, both replying with the protocol used. The TCP
+// server advertises the HTTP/3 one with Alt-Svc.
+func startHTTP3Server(t *testing.T) (*httptest.Server, *http3.Server) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	})
+
+	srv := httptest.NewUnstartedServer(handler)
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	udp, err := net.ListenPacket("udp", net.JoinHostPort("127.0.0.1", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h3srv := &http3.Server{
+		Handler:   handler,
+		TLSConfig: http3.ConfigureTLSConfig(srv.TLS.Clone()),
+	}
+	go h3srv.Serve(udp)
+	t.Cleanup(func() { h3srv.Close() })
+
+	srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Alt-Svc", `h3=":`+port+`"; ma=3600`)
+		handler(w, r)
+	})
+	return srv, h3srv
+}
+
+func getProto(t *testing.T, o *Options, url string) string {
+	rt, err := o.newTransport()
+	if err != nil {
+		t.Fatalf("newTransport() failed : %s", err)
+	}
+	c := &http.Client{Transport: rt}
+	resp, err := c.Get(url)
+	if err != nil {
+		t.Fatalf("GET %s failed : %s", url, err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if protoName(resp) == "HTTP/3" && string(body) != "HTTP/3.0" {
+		t.Errorf("Expected the server to see HTTP/3.0, but got %s", body)
+	}
+	return protoName(resp)
+}
+
+func TestHTTP3(t *testing.T) {
+	t.Log("Testing --http3 and --http3-only... (expecting the requests to go over QUIC)")
+
+	srv, _ := startHTTP3Server(t)
+
+	if proto := getProto(t, &Options{http3Only: true, insecure: true}, srv.URL); proto != "HTTP/3" {
+		t.Errorf("Expected HTTP/3 with --http3-only, but got %s", proto)
+	}
+	if proto := getProto(t, &Options{http3: true, insecure: true}, srv.URL); proto != "HTTP/3" {
+		t.Errorf("Expected HTTP/3 with --http3, but got %s", proto)
+	}
+}
+
+func TestHTTP3Fallback(t *testing.T) {
+	t.Log("Testing --http3 without a QUIC server... (expecting the fallback to TCP)")
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	if proto := getProto(t, &Options{http3: true, insecure: true}, srv.URL); proto != "HTTP/1.1" {
+		t.Errorf("Expected HTTP/1.1 after the fallback, but got %s", proto)
+	}
+
+	o := &Options{http3Only: true, insecure: true}
+	rt, _ := o.newTransport()
+	if _, err := (&http.Client{Transport: rt}).Get(srv.URL); err == nil {
+		t.Error("Expected an error with --http3-only")
+	}
+}
+
+func TestHTTP3Upload(t *testing.T) {
+	t.Log("Testing --http3 with -T... (expecting the upload to go over TCP)")
+
+	setProxyEnv(t, nil)
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(body)
+	}))
+	defer srv.Close()
+
+	file := filepath.Join(t.TempDir(), "upload.txt")
+	ioutil.WriteFile(file, []byte("uploaded"), 0644)
+	dir := t.TempDir()
+	opts := &Options{method: "GET", silent: true, http3: true, insecure: true, fileUpload: file,
+		outputFilename: filepath.Join(dir, "out")}
+	if err := run([]urlGroup{{opts, []string{srv.URL + "/"}}}); err != nil {
+		t.Fatalf("Expected the upload to succeed, but got %s", err)
+	}
+	if body, _ := ioutil.ReadFile(filepath.Join(dir, "out")); string(body) != "uploaded" {
+		t.Errorf("Expected the file to be uploaded, but got %q", body)
+	}
+}
+
+func TestAltSvcUpgrade(t *testing.T) {
+	t.Log("Testing --alt-svc... (expecting the advertised HTTP/3 service to be used and saved)")
+
+	srv, _ := startHTTP3Server(t)
+	file := filepath.Join(t.TempDir(), "altsvc.txt")
+	o := &Options{altSvc: file, insecure: true}
+
+	rt, err := o.newTransport()
+	if err != nil {
+		t.Fatalf("newTransport() failed : %s", err)
+	}
+	c := &http.Client{Transport: rt}
+	for i, want := range []string{"HTTP/2", "HTTP/3"} {
+		resp, err := c.Get(srv.URL)
+		if err != nil {
+			t.Fatalf("GET #%d failed : %s", i, err)
+		}
+		resp.Body.Close()
+		if proto := protoName(resp); proto != want {
+			t.Errorf("Expected %s for GET #%d, but got %s", want, i, proto)
+		}
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatalf("The alt-svc cache wasn't saved : %s", err)
+	}
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	if !strings.Contains(string(data), "h2 127.0.0.1 "+port+" h3 127.0.0.1 "+port+" \"") {
+		t.Errorf("Unexpected alt-svc cache :\n%s", data)
+	}
+
+	// A new invocation upgrades right away.
+	if proto := getProto(t, o, srv.URL); proto != "HTTP/3" {
+		t.Errorf("Expected HTTP/3 from the cache, but got %s", proto)
+	}
+}
+
+func TestParseAltSvc(t *testing.T) {
+	t.Log("Testing parseAltSvc()...")
+
+	now := time.Now()
+	services, clear := parseAltSvc(`h3=":443"; ma=60, h2="alt.example.com:8443"; persist=1`, now)
+	if clear || len(services) != 2 {
+		t.Fatalf("Expected 2 services, but got %v", services)
+	}
+	if s := services[0]; s.dstALPN != "h3" || s.dstHost != "" || s.dstPort != "443" || !s.expires.Equal(now.Add(time.Minute)) {
+		t.Errorf("Unexpected first service %+v", s)
+	}
+	if s := services[1]; s.dstHost != "alt.example.com" || s.dstPort != "8443" || !s.persist {
+		t.Errorf("Unexpected second service %+v", s)
+	}
+	if _, clear := parseAltSvc("clear", now); !clear {
+		t.Error("Expected clear for the \"clear\" value")
+	}
+}
+
+func TestUseQUIC(t *testing.T) {
+	t.Log("Testing h3Transport.useQUIC()... (expecting the proxied requests to stay on TCP)")
+
+	setProxyEnv(t, nil)
+	for _, proxy := range []string{"http://proxy:3128", "socks5h://proxy"} {
+		r, err := (&Options{proxy: proxy, noProxy: "direct.example"}).newProxyRouter()
+		if err != nil {
+			t.Fatal(err)
+		}
+		h3 := &h3Transport{d: &dialer{router: r}, always: true}
+		for target, expected := range map[string]bool{
+			"https://example.com/":        false,
+			"https://direct.example/":     true,
+			"http://direct.example/":      false,
+			"https://www.direct.example/": true,
+		} {
+			req, _ := http.NewRequest("GET", target, nil)
+			if got := h3.useQUIC(req); got != expected {
+				t.Errorf("Expected useQUIC() to be %t for %s through %s, but got %t", expected, target, proxy, got)
+			}
+		}
+	}
+}
@@ -2,21 +2,23 @@ package main
 
 import (
 	"bytes"
-	"crypto/tls"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"mime/multipart"
 	"net/http"
-	"net/http/httptrace"
+	"net/http/cookiejar"
 	"net/textproto"
 	"net/url"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/aki237/nscjar"
@@ -25,15 +27,12 @@ import (
 )
 
 var (
-	client   = http.Client{}
 	Status   = log.New(os.Stderr, "*", 0)
 	Incoming io.Writer
 	Outgoing io.Writer
 )
 
-const (
-	version string = "1.2.1"
-)
+const version string = "1.2.1"
 
 type LogWriter struct {
 	*log.Logger
@@ -54,54 +53,231 @@ func init() {
 }
 
 func main() {
-	var opts Options
+	groups, err := parseGroups(os.Args)
+	if err == nil && len(groups) > 0 {
+		err = run(groups)
+	}
+	if err != nil {
+		if !errors.Is(err, errReported) {
+			fmt.Fprintf(os.Stderr, "kurly : %s\n", err)
+		}
+		os.Exit(exitCodeFor(err))
+	}
+}
 
-	app := cli.NewApp()
-	app.Name = "kurly"
-	app.Usage = "[options] URL"
-	app.Version = version
+// pendingTransfer is a transfer to run, with the options of its group.
+type pendingTransfer struct {
+	opts *Options
+	url  globbedURL
+}
 
-	opts.getOptions(app)
+// run runs the transfers of every group of URLs. The cookies and the outputs
+// of the whole run, like --json-report and --har, are shared by all the
+// groups, with the options of the first one. The groups with the same
+// connection options share their connections.
+func run(groups []urlGroup) error {
+	opts := groups[0].opts
 
-	app.Action = func(c *cli.Context) error {
-		if c.NArg() == 0 {
-			cli.ShowAppHelp(c)
-			os.Exit(0)
+	trace, err := opts.openTrace()
+	if err != nil {
+		return err
+	}
+	if trace != nil {
+		defer trace.Close()
+	}
+
+	// The groups logging the TLS secrets to the same file share it.
+	keyLogs := make(map[string]io.Writer)
+	for _, g := range groups {
+		file := g.opts.keyLogFile()
+		if file != "" && keyLogs[file] == nil {
+			keyLog, err := g.opts.openKeyLog()
+			if err != nil {
+				return err
+			}
+			defer keyLog.Close()
+			keyLogs[file] = keyLog
 		}
+		g.opts.keyLogWriter = keyLogs[file]
+	}
 
-		err := opts.BuildCommonOptions(c)
-		if err != nil {
+	// Set up the transports, one per set of connection options
+	var built []*Options
+	for _, g := range groups {
+		g.opts.traceLog = trace
+		for _, o := range built {
+			if reflect.DeepEqual(o.connectionOptions(), g.opts.connectionOptions()) {
+				g.opts.transport = o.transport
+				break
+			}
+		}
+		if g.opts.transport == nil {
+			if g.opts.transport, err = g.opts.newTransport(); err != nil {
+				return err
+			}
+			built = append(built, g.opts)
+		}
+	}
+
+	// The cookies received by a group which uses them are sent with its next
+	// requests.
+	for _, g := range groups {
+		if g.opts.cookie != "" || g.opts.cookieJar != "" {
+			g.opts.jar, _ = cookiejar.New(nil)
+		}
+	}
+
+	var report io.WriteCloser
+	if opts.jsonReport != "" {
+		if report, err = opts.openJSONReport(); err != nil {
 			return err
 		}
+	}
+
+	// The groups naming the same -D or --cert-out file share it.
+	headerFiles := make(map[string]io.Writer)
+	certFiles := make(map[string]io.Writer)
+	var transfers []pendingTransfer
+	for _, g := range groups {
+		o := g.opts
+		if o.dumpHeader != "" && headerFiles[o.dumpHeader] == nil {
+			headerFile, err := o.openDumpHeader()
+			if err != nil {
+				return err
+			}
+			defer headerFile.Close()
+			headerFiles[o.dumpHeader] = headerFile
+			if opts.parallel {
+				headerFiles[o.dumpHeader] = &lockedWriter{w: headerFile}
+			}
+		}
+		o.headerFile = headerFiles[o.dumpHeader]
 
-		for _, uri := range c.Args() {
-			err := fetchUrl(uri, opts, c)
+		if o.certOut != "" && certFiles[o.certOut] == nil {
+			certFile, err := o.openCertOut()
 			if err != nil {
-				fmt.Fprintf(os.Stderr, "kurly : %s\n", err)
+				return err
+			}
+			defer certFile.Close()
+			certFiles[o.certOut] = certFile
+		}
+		o.certFile = certFiles[o.certOut]
+
+		urls, err := o.expandURLs(g.urls)
+		if err != nil {
+			return err
+		}
+		for _, u := range urls {
+			transfers = append(transfers, pendingTransfer{o, u})
+		}
+	}
+
+	var har *harLog
+	if opts.har != "" {
+		har = newHARLog()
+	}
+
+	// With --parallel, the progress of all the transfers is shown
+	// together, the messages being printed above it.
+	var meter *progressMeter
+	var stderr io.Writer = os.Stderr
+	if opts.parallel && !opts.silent {
+		meter = newProgressMeter(os.Stderr, len(transfers))
+		stderr = meter
+		Status.SetOutput(meter)
+	}
+
+	// Only the transfers of the groups with -v write to Incoming and
+	// Outgoing.
+	for _, g := range groups {
+		if g.opts.verbose {
+			Incoming.(*LogWriter).SetOutput(stderr)
+			Outgoing.(*LogWriter).SetOutput(stderr)
+			defer Incoming.(*LogWriter).SetOutput(ioutil.Discard)
+			defer Outgoing.(*LogWriter).SetOutput(ioutil.Discard)
+			break
+		}
+	}
+
+	// The reports of the transfers are written one at a time. As when the
+	// transfers run one after another, kurly exits with the code of the last
+	// one which failed, in the order of the command line.
+	var mu sync.Mutex
+	exitCode, failed := 0, -1
+	transfer := func(i int) {
+		t := transfers[i]
+		stats := newTransferStats(i)
+		if har != nil && opts.harMaxBody > 0 {
+			stats.captureBodies(opts.harMaxBody)
+		}
+		stats.bar = meter.add(t.url.url, stats)
+		err := fetchWithRetries(t.url, *t.opts, stats)
+		meter.remove(stats.bar)
+
+		mu.Lock()
+		defer mu.Unlock()
+		if certErr := t.opts.inspectCertificates(stats, err, stderr); err == nil {
+			err = certErr
+		}
+		stats.finish(err)
+		if err != nil {
+			fmt.Fprintf(stderr, "kurly : %s\n", err)
+			if i > failed {
+				exitCode, failed = exitCodeFor(err), i
 			}
 		}
-		return nil
+		if t.opts.writeOut != "" {
+			writeOut(t.opts.writeOut, stats, os.Stdout, stderr)
+		}
+		if report != nil {
+			if err := writeJSONReport(report, t.url.url, stats); err != nil {
+				fmt.Fprintf(stderr, "kurly : unable to write the JSON report; %s\n", err)
+			}
+		}
+		if har != nil {
+			// Saved after every transfer, so it is complete even if a
+			// later one aborts kurly.
+			har.add(stats)
+			if err := har.save(opts.har); err != nil {
+				fmt.Fprintf(stderr, "kurly : %s\n", err)
+			}
+		}
+	}
+
+	if opts.parallel {
+		opts.runParallel(len(transfers), transfer)
+	} else {
+		for i := range transfers {
+			transfer(i)
+		}
 	}
+	meter.stop()
+	Status.SetOutput(os.Stderr)
 
-	app.Run(os.Args)
+	if report != nil {
+		report.Close()
+	}
+	if exitCode != 0 {
+		return &exitError{code: exitCode, err: errReported}
+	}
+	return nil
 }
 
-func fetchUrl(target string, opts Options, c *cli.Context) error {
+// fetchUrl makes one attempt at the transfer of target, retry deciding
+// whether a failure is retried. It is nil without --retry.
+func fetchUrl(u globbedURL, opts Options, stats *transferStats, retry *retrier) error {
 	var remote *url.URL
-	var err error
-	var body io.Reader
+	target := u.url
 
-	body, err = opts.BuildTargetSpecificOptions(target)
+	t, err := opts.BuildTargetSpecificOptions(u)
 	if err != nil {
 		return err
 	}
+	body := t.body
 
-	client.CheckRedirect = opts.checkRedirect
-	if opts.insecure {
-		client.Transport = &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-		}
-	}
+	// Every transfer has its own client, sharing the transport and the cookies
+	// of its group, so that it follows the redirects with its own options.
+	client := http.Client{Transport: opts.transport, Jar: opts.jar, CheckRedirect: opts.checkRedirect}
 
 	if remote, err = url.Parse(target); err != nil {
 		return fmt.Errorf("Error: %s does not parse correctly as a URL", target)
@@ -112,9 +288,16 @@ func fetchUrl(target string, opts Options, c *cli.Context) error {
 		remote, _ = url.Parse(remote.String())
 	}
 
-	outputFile := opts.openOutputFile()
+	outputFile, err := t.openOutputFile()
+	if err != nil {
+		return err
+	}
+	if t.outputFilename != "" {
+		defer outputFile.Close()
+	}
+	stats.outputFile = t.outputFilename
 
-	if opts.method == http.MethodPut {
+	if t.method == http.MethodPut {
 		// TODO : add support for reading contents from stdin
 		if strings.HasSuffix(remote.Path, "/") {
 			remote.Path = filepath.Join(remote.Path, filepath.Base(opts.fileUpload))
@@ -138,21 +321,32 @@ func fetchUrl(target string, opts Options, c *cli.Context) error {
 		}
 	}
 
-	req, err := http.NewRequest(opts.method, target, body)
+	timer := opts.newTransferTimer(stats.transferred)
+	defer timer.stop()
+
+	req, err := http.NewRequestWithContext(timer.ctx, t.method, target, body)
 	if err != nil {
-		Status.Fatalf("Error: unable to create http %s request; %s\n", opts.method, err)
+		return withExitCode(exitURLMalformed, fmt.Errorf("unable to create http %s request; %w", t.method, err))
 	}
 
+	req = stats.attach(req)
+	if req.Body != nil && req.Body != http.NoBody {
+		var r io.Reader = opts.rateLimited(req.Body)
+		if stats.reqBody != nil {
+			r = io.TeeReader(r, stats.reqBody)
+		}
+		req.Body = &countingReadCloser{countingReader{r, &stats.uploaded}, req.Body}
+	}
 	if opts.verbose {
-		req = req.WithContext(httptrace.WithClientTrace(req.Context(), NewClientTraceForRequest(req)))
+		req = traceRequest(req)
 	}
 
 	// Seek to given offset of the file and set the "Range" header
 	if continueAtInt > 0 {
-		if opts.outputFilename != "" {
+		if t.outputFilename != "" {
 			_, err = outputFile.Seek(int64(continueAtInt), 0)
 			if err != nil {
-				Status.Fatalf("Error: seek in the given output file; %s\n", err)
+				return withExitCode(exitWriteError, fmt.Errorf("unable to seek in the output file; %w", err))
 			}
 		}
 		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", continueAtInt))
@@ -162,13 +356,16 @@ func fetchUrl(target string, opts Options, c *cli.Context) error {
 		req.Header.Set("Authorization", "Basic "+encodeToBase64(opts.user))
 	}
 	req.Header.Set("Accept", "*/*")
+	if opts.compressed {
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+	}
 	req.Header.Set("Host", remote.Host)
 	if body != nil {
 		switch b := body.(type) {
 		case *os.File:
 			fi, err := b.Stat()
 			if err != nil {
-				Status.Fatalf("Unable to get file stats for %v\n", opts.fileUpload)
+				return withExitCode(exitReadError, fmt.Errorf("unable to get file stats for %v; %w", opts.fileUpload, err))
 			}
 			req.ContentLength = fi.Size()
 			req.Header.Set("Content-Length", strconv.FormatInt(fi.Size(), 10))
@@ -179,31 +376,79 @@ func fetchUrl(target string, opts Options, c *cli.Context) error {
 			req.Header.Set("Content-Length", strconv.FormatInt(int64(b.Len()), 10))
 		}
 	}
-	setHeaders(req, opts.headers)
+	stats.bar.setUpload(req.ContentLength)
+	setHeaders(req, t.headers)
 	setCookieHeader(req, opts.cookie)
 
 	resp, err := client.Do(req)
 	if err != nil {
+		err = timer.check(err)
+		if limits := opts.tlsLimits(); limits != "" && isTLSHandshakeError(err) {
+			return fmt.Errorf("unable to negotiate TLS with %s within the requested limits (%s); %w", remote.Host, limits, err)
+		}
 		return err
 	}
 	defer resp.Body.Close()
+	stats.gotResponse(resp)
 
-	if continueAtInt > 0 && resp.StatusCode == 416 {
-		return fmt.Errorf("unable to get URL; %s\n", "Either the server doesn't support ranges or an invalid range is passed")
+	// Saved first, so that they are kept even if the transfer fails later.
+	if opts.cookieJar != "" && len(resp.Cookies()) > 0 {
+		cookies := resp.Cookies()
+		for _, val := range cookies {
+			if val.Domain == "" {
+				u, err := resp.Location()
+				if err != nil {
+					u = req.URL
+				}
+
+				val.Domain = u.Hostname()
+			}
+		}
+		saveCookies(cookies, opts.cookieJar)
+	}
+
+	if err := retry.retryResponse(resp); err != nil {
+		return err
+	}
+	if err := retry.startOver(outputFile, resp); err != nil {
+		return err
 	}
 
-	fmt.Fprintf(Incoming, "%s %s\n", resp.Proto, resp.Status)
+	if opts.headerFile != nil {
+		if err := writeHeaders(opts.headerFile, stats); err != nil {
+			return fmt.Errorf("unable to write the headers; %s", err)
+		}
+	}
+	if opts.fail && resp.StatusCode >= 400 {
+		return httpStatusError(resp.StatusCode)
+	}
+	if opts.include {
+		if err := writeHeaders(outputFile, stats); err != nil {
+			return withExitCode(exitWriteError, fmt.Errorf("unable to write the headers; %w", err))
+		}
+	}
 
-	for k, v := range resp.Header {
-		fmt.Fprintln(Incoming, k, v)
+	if continueAtInt > 0 && resp.StatusCode == 416 {
+		return withExitCode(exitRangeError, errors.New("unable to get URL; either the server doesn't support ranges or an invalid range is passed"))
 	}
 
-	fmt.Fprintln(Incoming)
+	if opts.verbose {
+		fmt.Fprintf(Incoming, "%s %s\n", protoName(resp), resp.Status)
+
+		for k, v := range resp.Header {
+			fmt.Fprintln(Incoming, k, v)
+		}
+
+		fmt.Fprintln(Incoming)
+	}
 
 	if !opts.head {
-		if !opts.silent {
-			progressR := &ioprogress.Reader{
-				Reader: resp.Body,
+		// The progress is the one of the bytes received, before decoding.
+		var src io.Reader = &countingReader{opts.rateLimited(resp.Body), &stats.downloaded}
+		stats.bar.setDownload(resp.ContentLength)
+		if !opts.silent && !opts.parallel {
+			src = &ioprogress.Reader{
+				Reader: src,
 				Size:   resp.ContentLength,
 				DrawFunc: ioprogress.DrawTerminalf(os.Stderr, func(progress, total int64) string {
 					return fmt.Sprintf(
@@ -212,40 +457,38 @@ func fetchUrl(target string, opts Options, c *cli.Context) error {
 						ioprogress.DrawTextFormatBytes(progress, total))
 				}),
 			}
-			if _, err = io.Copy(outputFile, progressR); err != nil {
-				return fmt.Errorf("failed to copy URL content; %s", err)
+		}
+		if opts.compressed && !opts.raw {
+			decoded, err := decodeBody(src, resp.Header.Get("Content-Encoding"))
+			if err != nil {
+				return withExitCode(exitBadContentEncoding, err)
 			}
+			defer decoded.Close()
+			src = decoded
 		}
-		if opts.silent {
-			if _, err = io.Copy(outputFile, resp.Body); err != nil {
-				return fmt.Errorf("failed to copy URL content; %s", err)
+		if stats.respBody != nil {
+			src = io.TeeReader(src, stats.respBody)
+		}
+		if n, err := io.Copy(outputWriter{outputFile}, src); err != nil {
+			fromStart := opts.include || opts.compressed && !opts.raw
+			retry.failedDownload(outputFile, t.outputFilename != "", fromStart, n > 0 || opts.include)
+			err = timer.check(fmt.Errorf("failed to copy URL content; %w", err))
+			if isTimeout(err) {
+				return err
 			}
+			return withExitCode(exitRecvError, err)
 		}
 	}
 
-	if opts.outputFilename != "" {
-		outputFile.Close()
-	}
-
 	if rTime := resp.Header.Get("Last-Modified"); opts.remoteTime && rTime != "" {
-		if t, err := time.Parse("Mon, 02 Jan 2006 15:04:05 MST", rTime); err == nil {
-			os.Chtimes(opts.outputFilename, t, t)
+		if mtime, err := time.Parse("Mon, 02 Jan 2006 15:04:05 MST", rTime); err == nil {
+			os.Chtimes(t.outputFilename, mtime, mtime)
 		}
 	}
 
-	if opts.cookieJar != "" && len(resp.Cookies()) > 0 {
-		cookies := resp.Cookies()
-		for _, val := range cookies {
-			if val.Domain == "" {
-				u, err := resp.Location()
-				if err != nil {
-					u = req.URL
-				}
-
-				val.Domain = u.Hostname()
-			}
-		}
-		saveCookies(cookies, opts.cookieJar)
+	// The body is written, the transfer still fails.
+	if opts.failWithBody && resp.StatusCode >= 400 {
+		return httpStatusError(resp.StatusCode)
 	}
 	return nil
 }
@@ -371,8 +614,7 @@ func setCookieHeader(r *http.Request, arg string) {
 		}
 
 		// Path matching (according to rfc6265::Section-5.1.4)
-		uri, _ := url.Parse("http://" + val.Domain + val.Path)
-		if strings.HasPrefix(r.URL.Path, uri.Path) && r.URL.Path != uri.Path {
+		if !cookiePathMatch(r.URL.Path, val.Path) {
 			continue
 		}
 
@@ -380,7 +622,27 @@ func setCookieHeader(r *http.Request, arg string) {
 	}
 }
 
+// cookiePathMatch tells whether the cookie path matches the path of the
+// request, a cookie without a path matching all of them.
+func cookiePathMatch(reqPath, cookiePath string) bool {
+	if cookiePath == "" || reqPath == cookiePath {
+		return true
+	}
+	if reqPath == "" {
+		reqPath = "/"
+	}
+	return strings.HasPrefix(reqPath, cookiePath) &&
+		(strings.HasSuffix(cookiePath, "/") || reqPath[len(cookiePath)] == '/')
+}
+
+// cookieJarMu serializes the updates of the cookie jar by the parallel
+// transfers.
+var cookieJarMu sync.Mutex
+
 func saveCookies(cs []*http.Cookie, filename string) {
+	cookieJarMu.Lock()
+	defer cookieJarMu.Unlock()
+
 	f, err := os.OpenFile(filename, os.O_CREATE|os.O_RDWR, 0666)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Warning : unable to save the cookie to the file : %s\n", err)
@@ -413,11 +675,18 @@ func saveCookies(cs []*http.Cookie, filename string) {
 	}
 }
 
-func maxTime(maxTime uint) {
-	go func() {
-		<-time.After(time.Duration(maxTime) * time.Second)
-		Status.Fatalf("Error: Maximum operation time of %d seconds expired, aborting\n", maxTime)
-	}()
+// outputWriter tags the errors writing the output, which have their own
+// exit code.
+type outputWriter struct {
+	io.Writer
+}
+
+func (w outputWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	if err != nil {
+		err = withExitCode(exitWriteError, err)
+	}
+	return n, err
 }
 
 func encodeToBase64(a string) string {
@@ -29,6 +29,27 @@ func TestSetHeaders(t *testing.T) {
 	}
 }
 
+func TestCookiePathMatch(t *testing.T) {
+	t.Log("Testing cookiePathMatch()... (expecting the path-match of RFC 6265)")
+
+	for _, c := range []struct {
+		reqPath, cookiePath string
+		expected            bool
+	}{
+		{"/resource", "", true},
+		{"/resource", "/", true},
+		{"/docs/page", "/docs", true},
+		{"/docs", "/docs", true},
+		{"/docs/page", "/docs/", true},
+		{"/docsets", "/docs", false},
+		{"/", "/docs", false},
+	} {
+		if got := cookiePathMatch(c.reqPath, c.cookiePath); got != c.expected {
+			t.Errorf("Expected %t for %s and the cookie path %q, but got %t", c.expected, c.reqPath, c.cookiePath, got)
+		}
+	}
+}
+
 /*** Need to investigate `go test -race` which causes this to fail and break CI
 func TestMaxTime(t *testing.T) {
 	t.Log("Testing maxTime()... (expecting no timeout)")
@@ -20,7 +20,10 @@ kurly is designed to operate in a similar manner to curl, with select features.
 %build
 export CGO_ENABLED=0
 export GOPATH=/tmp/gopath/
-go get -v -d ./...
+go mod init github.com/davidjpeacock/kurly
+go get github.com/quic-go/quic-go@v0.41.0 golang.org/x/net@v0.30.0 golang.org/x/crypto@v0.28.0 \
+    software.sslmate.com/src/go-pkcs12@v0.5.0 github.com/andybalholm/brotli@v1.1.1 github.com/klauspost/compress@v1.18.0
+go mod tidy
 go build -a -ldflags "-s -w -B 0x$(head -c20 /dev/urandom|od -An -tx1|tr -d ' \n')" -o kurly
 
 %install
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/davidjpeacock/cli"
+)
+
+// urlGroup is a group of URLs of the command line, separated from the next
+// one by --next, with its own options.
+type urlGroup struct {
+	opts *Options
+	urls []string
+}
+
+// splitNext splits the arguments of the command line into the ones of each
+// group, at every --next or -:.
+func splitNext(args []string) [][]string {
+	groups := [][]string{nil}
+	for _, arg := range args {
+		if arg == "--next" || arg == "-:" {
+			groups = append(groups, nil)
+			continue
+		}
+		groups[len(groups)-1] = append(groups[len(groups)-1], arg)
+	}
+	return groups
+}
+
+// runOptions are the options about the whole run, only read from the first
+// group.
+var runOptions = []string{"parallel", "parallel-max", "json-report", "har", "har-max-body", "trace", "trace-ascii", "trace-time"}
+
+func newApp(opts *Options) *cli.App {
+	app := cli.NewApp()
+	app.Name = "kurly"
+	app.Usage = "[options] URL [--next [options] URL]..."
+	app.Version = version
+	opts.getOptions(app)
+	return app
+}
+
+// parseGroups parses the command line, args being os.Args. It returns no
+// group when kurly has nothing more to do, like after printing its help or
+// its version.
+func parseGroups(args []string) ([]urlGroup, error) {
+	var groups []urlGroup
+	split := splitNext(args[1:])
+	for i, groupArgs := range split {
+		opts := &Options{}
+		app := newApp(opts)
+		parsed := false
+		app.Action = func(c *cli.Context) error {
+			parsed = true
+			if c.NArg() == 0 {
+				if len(split) == 1 {
+					cli.ShowAppHelp(c)
+					os.Exit(0)
+				}
+				return withExitCode(exitURLMalformed, fmt.Errorf("no URL specified in the group of options number %d", i+1))
+			}
+			if i > 0 {
+				for _, name := range runOptions {
+					if c.IsSet(name) {
+						return fmt.Errorf("--%s applies to the whole run, it must be given before the first --next", name)
+					}
+				}
+			}
+			groups = append(groups, urlGroup{opts: opts, urls: c.Args()})
+			return opts.BuildCommonOptions(c)
+		}
+		if err := app.Run(append([]string{args[0]}, groupArgs...)); err != nil {
+			return nil, err
+		}
+		if !parsed {
+			return nil, nil
+		}
+	}
+	return groups, nil
+}
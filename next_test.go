@@ -0,0 +1,144 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplitNext(t *testing.T) {
+	t.Log("Testing splitNext()... (expecting a group of arguments per --next)")
+
+	got := splitNext([]string{"-d", "a=b", "http://a/login", "--next", "-o", "out", "http://a/file", "-:", "http://b/"})
+	expected := [][]string{{"-d", "a=b", "http://a/login"}, {"-o", "out", "http://a/file"}, {"http://b/"}}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %v, but got %v", expected, got)
+	}
+}
+
+func TestRunGroups(t *testing.T) {
+	t.Log("Testing run()... (expecting every group with its own options, and its own cookies)")
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/login" {
+			if r.Method != "POST" {
+				t.Errorf("Expected a POST to log in, but got %s", r.Method)
+			}
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "42"})
+			return
+		}
+		c, err := r.Cookie("session")
+		if r.URL.Path == "/public" {
+			if r.Method != "GET" || err == nil {
+				t.Errorf("Expected a GET without cookie, but got %s with %v", r.Method, r.Header["Cookie"])
+			}
+			return
+		}
+		if err != nil || c.Value != "42" {
+			t.Errorf("Expected the session cookie, but got %v", r.Header["Cookie"])
+		}
+		w.Write([]byte("secret"))
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	login := &Options{method: "GET", silent: true, data: []string{"user=me"}, cookieJar: filepath.Join(dir, "jar"),
+		outputFilename: filepath.Join(dir, "#1")}
+	public := &Options{method: "GET", silent: true, outputFilename: filepath.Join(dir, "public")}
+	err := run([]urlGroup{{login, []string{srv.URL + "/{login,resource}"}}, {public, []string{srv.URL + "/public"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, _ := ioutil.ReadFile(filepath.Join(dir, "resource")); string(body) != "secret" {
+		t.Errorf("Expected the resource to be saved, but got %q", body)
+	}
+}
+
+func TestRunGroupsConnections(t *testing.T) {
+	t.Log("Testing run()... (expecting the connection options and -v of every group to apply to it only)")
+
+	setProxyEnv(t, nil)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Path", r.URL.Path)
+	})
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+	tlsSrv := httptest.NewTLSServer(handler)
+	defer tlsSrv.Close()
+
+	stderr := os.Stderr
+	defer func() { os.Stderr = stderr }()
+	os.Stderr, _ = os.Create(filepath.Join(t.TempDir(), "stderr"))
+
+	dir := t.TempDir()
+	groups := []urlGroup{
+		{&Options{method: "GET", silent: true, verbose: true, outputFilename: filepath.Join(dir, "1")}, []string{srv.URL + "/verbose"}},
+		{&Options{method: "GET", silent: true, insecure: true, outputFilename: filepath.Join(dir, "2")}, []string{tlsSrv.URL + "/insecure"}},
+		{&Options{method: "GET", silent: true, insecure: true, outputFilename: filepath.Join(dir, "3")}, []string{tlsSrv.URL + "/again"}},
+	}
+	if err := run(groups); err != nil {
+		t.Fatalf("Expected -k to apply to the second group, but got %s", err)
+	}
+	if groups[1].opts.transport == groups[0].opts.transport || groups[2].opts.transport != groups[1].opts.transport {
+		t.Errorf("Expected a transport per set of connection options")
+	}
+
+	os.Stderr.Close()
+	log, _ := ioutil.ReadFile(os.Stderr.Name())
+	if !strings.Contains(string(log), "< X-Path [/verbose]") {
+		t.Errorf("Expected the verbose output of the first group, but got %q", log)
+	}
+	if strings.Contains(string(log), "/insecure") || strings.Contains(string(log), "/again") {
+		t.Errorf("Expected no verbose output for the other groups, but got %q", log)
+	}
+}
+
+func TestParseGroups(t *testing.T) {
+	t.Log("Testing parseGroups()... (expecting the options about the whole run in the first group only)")
+
+	groups, err := parseGroups([]string{"kurly", "-Z", "--har", "out.har", "http://a/", "--next", "-k", "http://b/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 2 || !groups[0].opts.parallel || groups[0].opts.har != "out.har" || !groups[1].opts.insecure {
+		t.Errorf("Expected two groups with their options, but got %+v", groups)
+	}
+
+	for _, args := range [][]string{
+		{"http://a/", "--next", "-Z", "http://b/"},
+		{"http://a/", "--next", "--parallel-max", "3", "http://b/"},
+		{"http://a/", "--next", "--json-report", "-", "http://b/"},
+		{"http://a/", "--next", "http://b/", "-:", "--trace-ascii", "-", "http://c/"},
+	} {
+		if _, err := parseGroups(append([]string{"kurly"}, args...)); err == nil || !strings.Contains(err.Error(), "before the first --next") {
+			t.Errorf("Expected an error for %q, but got %v", args, err)
+		}
+	}
+}
+
+func TestRunGroupsSharedFiles(t *testing.T) {
+	t.Log("Testing run()... (expecting the groups naming the same -D file to share it)")
+
+	setProxyEnv(t, nil)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Path", r.URL.Path)
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	headers := filepath.Join(dir, "headers")
+	first := &Options{method: "GET", silent: true, dumpHeader: headers, outputFilename: filepath.Join(dir, "1")}
+	second := &Options{method: "GET", silent: true, dumpHeader: headers, outputFilename: filepath.Join(dir, "2")}
+	if err := run([]urlGroup{{first, []string{srv.URL + "/first"}}, {second, []string{srv.URL + "/second"}}}); err != nil {
+		t.Fatal(err)
+	}
+	dump, _ := ioutil.ReadFile(headers)
+	if !strings.Contains(string(dump), "X-Path: /first\r\n") || !strings.Contains(string(dump), "X-Path: /second\r\n") {
+		t.Errorf("Expected the headers of both groups, but got %q", dump)
+	}
+}
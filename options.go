@@ -13,7 +13,6 @@ import (
 	"path"
 	"path/filepath"
 	"strings"
-	"time"
 
 	"github.com/alsm/ioprogress"
 	"github.com/davidjpeacock/cli"
@@ -32,9 +31,18 @@ type Options struct {
 	outputFilename string
 	fileUpload     string
 	remoteName     bool
+	globOff        bool
+	parallel       bool
+	parallelMax    uint
 	continueAt     string
 	verbose        bool
 	maxTime        uint
+	connectTimeout uint
+	speedLimit     uint
+	speedTime      uint
+	keepaliveTime  uint
+	limitRate      string
+	rateLimit      int64 // --limit-rate, in bytes per second
 	remoteTime     bool
 	cookie         string
 	cookieJar      string
@@ -55,7 +63,70 @@ type Options struct {
 	form           []string
 	head           bool
 	insecure       bool
+	proxy          string
+	proxyUser      string
+	noProxy        string
+	socks5         string
+	socks5Hostname string
+	caCert         string
+	caPath         string
+	cert           string
+	certType       string
+	key            string
+	pass           string
+	tlsv10         bool
+	tlsv11         bool
+	tlsv12         bool
+	tlsv13         bool
+	tlsMax         string
+	ciphers        string
+	curves         string
+	pinnedPubKey   string
+	certStatus     bool
+	certInfo       bool
+	certOut        string
+	certFile       io.Writer // the --cert-out file, once opened
+	certExpiryDays uint
+	certExpiryFail bool
+	keyLog         string
+	resolve        []string
+	connectTo      []string
+	unixSocket     string
+	abstractSocket string
+	http10         bool
+	http11         bool
+	http2          bool
+	priorKnowledge bool
+	http3          bool
+	http3Only      bool
+	altSvc         string
+	compressed     bool
+	raw            bool
+	writeOut       string
+	jsonReport     string
+	fail           bool
+	failWithBody   bool
+	retry          uint
+	retryDelay     uint
+	retryMaxTime   uint
+	retryRefused   bool
+	retryAllErrors bool
+	har            string
+	harMaxBody     int
+	dumpHeader     string
+	include        bool
+	headerFile     io.Writer // the --dump-header file, once opened
+	traceLog       *traceLog // the --trace or --trace-ascii dump, once opened
+	keyLogWriter   io.Writer // the --keylog file, once opened
+	trace          string
+	traceASCII     string
+	traceTime      bool
 	fdata          FormData // fdata is the field for processed form data
+	// transport is the transport of the group, once built, shared with the
+	// groups with the same connection options
+	transport http.RoundTripper
+	// jar keeps the cookies received by the group, with -b or -c
+	jar http.CookieJar
 }
 
 func (o *Options) getOptions(app *cli.App) {
@@ -75,6 +146,27 @@ func (o *Options) getOptions(app *cli.App) {
 			Usage:       "Save output to file named with file part of URL",
 			Destination: &o.remoteName,
 		},
+		cli.BoolFlag{
+			Name:        "globoff, g",
+			Usage:       "Take the URLs literally, without expanding their {} sets and [] ranges",
+			Destination: &o.globOff,
+		},
+		// Only for the help, the groups being split before the parsing.
+		cli.BoolFlag{
+			Name:  "next, :",
+			Usage: "Start a new group of URLs, with their own options",
+		},
+		cli.BoolFlag{
+			Name:        "parallel, Z",
+			Usage:       "Run the transfers in parallel",
+			Destination: &o.parallel,
+		},
+		cli.UintFlag{
+			Name:        "parallel-max",
+			Usage:       "Maximum number of transfers run at the same time with --parallel",
+			Destination: &o.parallelMax,
+			Value:       50,
+		},
 		cli.StringFlag{
 			Name:        "continue-at, C",
 			Usage:       "Resume transfer from offset",
@@ -87,9 +179,34 @@ func (o *Options) getOptions(app *cli.App) {
 		},
 		cli.UintFlag{
 			Name:        "max-time, m",
-			Usage:       "Maximum time to wait for an operation to complete in seconds",
+			Usage:       "Maximum time in seconds for each transfer to complete",
 			Destination: &o.maxTime,
 		},
+		cli.UintFlag{
+			Name:        "connect-timeout",
+			Usage:       "Maximum time in seconds to connect, and then for the TLS handshake",
+			Destination: &o.connectTimeout,
+		},
+		cli.UintFlag{
+			Name:        "speed-limit, Y",
+			Usage:       "Abort the transfer when slower than this many bytes per second for --speed-time",
+			Destination: &o.speedLimit,
+		},
+		cli.UintFlag{
+			Name:        "speed-time, y",
+			Usage:       "Abort the transfer when slower than --speed-limit for this many seconds",
+			Destination: &o.speedTime,
+		},
+		cli.UintFlag{
+			Name:        "keepalive-time",
+			Usage:       "Interval in seconds between the TCP keepalive probes",
+			Destination: &o.keepaliveTime,
+		},
+		cli.StringFlag{
+			Name:        "limit-rate",
+			Usage:       "Maximum transfer rate in bytes per second, with K, M or G suffixes, for downloads and uploads",
+			Destination: &o.limitRate,
+		},
 		cli.BoolFlag{
 			Name:        "R",
 			Usage:       "Set the timestamp of the local file to that of the remote file, if available",
@@ -172,6 +289,66 @@ func (o *Options) getOptions(app *cli.App) {
 			Name:  "form, F",
 			Usage: "Send HTTP multipart post data",
 		},
+		cli.StringFlag{
+			Name:        "dump-header, D",
+			Usage:       "Write the received headers to this file, - for stdout (the HTTP/2 and HTTP/3 ones sorted, as their order is lost)",
+			Destination: &o.dumpHeader,
+		},
+		cli.BoolFlag{
+			Name:        "include, i",
+			Usage:       "Include the received headers in the output",
+			Destination: &o.include,
+		},
+		cli.StringFlag{
+			Name:        "trace",
+			Usage:       "Write a hex dump of all the data sent and received to this file, - for stdout",
+			Destination: &o.trace,
+		},
+		cli.StringFlag{
+			Name:        "trace-ascii",
+			Usage:       "Write a text dump of all the data sent and received to this file, - for stdout",
+			Destination: &o.traceASCII,
+		},
+		cli.BoolFlag{
+			Name:        "trace-time",
+			Usage:       "Add a timestamp to every line of --trace and --trace-ascii",
+			Destination: &o.traceTime,
+		},
+		cli.BoolFlag{
+			Name:        "fail, f",
+			Usage:       "Fail with exit code 22 on HTTP errors (4xx and 5xx), without writing the body",
+			Destination: &o.fail,
+		},
+		cli.BoolFlag{
+			Name:        "fail-with-body",
+			Usage:       "Fail with exit code 22 on HTTP errors (4xx and 5xx), after writing the body",
+			Destination: &o.failWithBody,
+		},
+		cli.UintFlag{
+			Name:        "retry",
+			Usage:       "Retry the transfer this many times on transient errors",
+			Destination: &o.retry,
+		},
+		cli.UintFlag{
+			Name:        "retry-delay",
+			Usage:       "Wait this many seconds between the retries, instead of an exponential backoff",
+			Destination: &o.retryDelay,
+		},
+		cli.UintFlag{
+			Name:        "retry-max-time",
+			Usage:       "Retry only within this many seconds from the first attempt",
+			Destination: &o.retryMaxTime,
+		},
+		cli.BoolFlag{
+			Name:        "retry-connrefused",
+			Usage:       "Also retry on refused connections, with --retry",
+			Destination: &o.retryRefused,
+		},
+		cli.BoolFlag{
+			Name:        "retry-all-errors",
+			Usage:       "Retry on any error, with --retry",
+			Destination: &o.retryAllErrors,
+		},
 		cli.BoolFlag{
 			Name:        "head, I",
 			Usage:       "Get HEAD from URL only",
@@ -182,6 +359,215 @@ func (o *Options) getOptions(app *cli.App) {
 			Usage:       "Allow insecure server connections when using TLS",
 			Destination: &o.insecure,
 		},
+		cli.StringFlag{
+			Name:        "proxy, x",
+			Usage:       "Use the specified HTTP(S) or SOCKS proxy, [protocol://]host[:port]",
+			Destination: &o.proxy,
+		},
+		cli.StringFlag{
+			Name:        "proxy-user, U",
+			Usage:       "User and password to use for proxy authentication, user:password",
+			Destination: &o.proxyUser,
+		},
+		cli.StringFlag{
+			Name:        "noproxy",
+			Usage:       "Comma separated list of hosts which do not use a proxy",
+			Destination: &o.noProxy,
+		},
+		cli.StringFlag{
+			Name:        "socks5",
+			Usage:       "SOCKS5 proxy to use, resolving host names locally, host[:port]",
+			Destination: &o.socks5,
+		},
+		cli.StringFlag{
+			Name:        "socks5-hostname",
+			Usage:       "SOCKS5 proxy to use, letting the proxy resolve host names, host[:port]",
+			Destination: &o.socks5Hostname,
+		},
+		cli.StringFlag{
+			Name:        "cacert",
+			Usage:       "CA certificates bundle (PEM) to verify the peer with, instead of the system ones",
+			Destination: &o.caCert,
+		},
+		cli.StringFlag{
+			Name:        "capath",
+			Usage:       "Directory of CA certificates (PEM) to verify the peer with, instead of the system ones",
+			Destination: &o.caPath,
+		},
+		cli.StringFlag{
+			Name:        "cert, E",
+			Usage:       "Client certificate file and optional password, certificate[:password]",
+			Destination: &o.cert,
+		},
+		cli.StringFlag{
+			Name:        "cert-type",
+			Usage:       "Client certificate type, PEM or P12",
+			Destination: &o.certType,
+			Value:       "PEM",
+		},
+		cli.StringFlag{
+			Name:        "key",
+			Usage:       "Private key file (PEM) of the client certificate",
+			Destination: &o.key,
+		},
+		cli.StringFlag{
+			Name:        "pass",
+			Usage:       "Passphrase of the private key or of the PKCS#12 bundle",
+			Destination: &o.pass,
+		},
+		cli.BoolFlag{
+			Name:        "tlsv1.0, tlsv1",
+			Usage:       "Use TLSv1.0 or greater",
+			Destination: &o.tlsv10,
+		},
+		cli.BoolFlag{
+			Name:        "tlsv1.1",
+			Usage:       "Use TLSv1.1 or greater",
+			Destination: &o.tlsv11,
+		},
+		cli.BoolFlag{
+			Name:        "tlsv1.2",
+			Usage:       "Use TLSv1.2 or greater",
+			Destination: &o.tlsv12,
+		},
+		cli.BoolFlag{
+			Name:        "tlsv1.3",
+			Usage:       "Use TLSv1.3 or greater",
+			Destination: &o.tlsv13,
+		},
+		cli.StringFlag{
+			Name:        "tls-max",
+			Usage:       "Maximum TLS version to use, 1.0, 1.1, 1.2 or 1.3",
+			Destination: &o.tlsMax,
+		},
+		cli.StringFlag{
+			Name:        "ciphers",
+			Usage:       "Colon separated list of cipher suites to use for TLSv1.2 and older (OpenSSL names)",
+			Destination: &o.ciphers,
+		},
+		cli.StringFlag{
+			Name:        "curves",
+			Usage:       "Colon separated list of key exchange curves to use, like X25519:P-256",
+			Destination: &o.curves,
+		},
+		cli.StringFlag{
+			Name:        "pinnedpubkey",
+			Usage:       "Public key (PEM/DER file) or sha256//<hash> list to verify the peer against",
+			Destination: &o.pinnedPubKey,
+		},
+		cli.BoolFlag{
+			Name:        "cert-status",
+			Usage:       "Require a valid OCSP response stapled by the server for its certificate",
+			Destination: &o.certStatus,
+		},
+		cli.BoolFlag{
+			Name:        "cert-info",
+			Usage:       "Describe every certificate of the server chain after the transfer",
+			Destination: &o.certInfo,
+		},
+		cli.StringFlag{
+			Name:        "cert-out",
+			Usage:       "Save the certificate chain of the server to this PEM file",
+			Destination: &o.certOut,
+		},
+		cli.UintFlag{
+			Name:        "cert-expiry-days",
+			Usage:       "Warn when a certificate of the server chain expires within this many days",
+			Destination: &o.certExpiryDays,
+		},
+		cli.BoolFlag{
+			Name:        "cert-expiry-fail",
+			Usage:       "Fail rather than warn with --cert-expiry-days",
+			Destination: &o.certExpiryFail,
+		},
+		cli.StringFlag{
+			Name:        "keylog",
+			Usage:       "Append the TLS session secrets to this file, for Wireshark (default $SSLKEYLOGFILE)",
+			Destination: &o.keyLog,
+		},
+		cli.StringSliceFlag{
+			Name:  "resolve",
+			Usage: "Resolve the host and port to the given addresses, host:port:addr[,addr]",
+		},
+		cli.StringSliceFlag{
+			Name:  "connect-to",
+			Usage: "Connect to host2:port2 instead of host1:port1, host1:port1:host2:port2",
+		},
+		cli.StringFlag{
+			Name:        "unix-socket",
+			Usage:       "Connect through this Unix domain socket instead of using the network",
+			Destination: &o.unixSocket,
+		},
+		cli.StringFlag{
+			Name:        "abstract-unix-socket",
+			Usage:       "Connect through this abstract Unix domain socket instead of using the network (Linux only)",
+			Destination: &o.abstractSocket,
+		},
+		cli.BoolFlag{
+			Name:        "http1.0, 0",
+			Usage:       "Use HTTP/1.0",
+			Destination: &o.http10,
+		},
+		cli.BoolFlag{
+			Name:        "http1.1",
+			Usage:       "Use HTTP/1.1 only, never HTTP/2",
+			Destination: &o.http11,
+		},
+		cli.BoolFlag{
+			Name:        "http2",
+			Usage:       "Use HTTP/2 when the server supports it (default)",
+			Destination: &o.http2,
+		},
+		cli.BoolFlag{
+			Name:        "http2-prior-knowledge",
+			Usage:       "Use HTTP/2 right away, also in cleartext for http:// URLs",
+			Destination: &o.priorKnowledge,
+		},
+		cli.BoolFlag{
+			Name:        "http3",
+			Usage:       "Use HTTP/3 for https:// URLs, falling back to TCP if QUIC fails",
+			Destination: &o.http3,
+		},
+		cli.BoolFlag{
+			Name:        "http3-only",
+			Usage:       "Use HTTP/3 for https:// URLs, without any fallback",
+			Destination: &o.http3Only,
+		},
+		cli.StringFlag{
+			Name:        "alt-svc",
+			Usage:       "Read and update the Alt-Svc cache in this file",
+			Destination: &o.altSvc,
+		},
+		cli.BoolFlag{
+			Name:        "compressed",
+			Usage:       "Request a compressed response (deflate, gzip, br or zstd) and decode it",
+			Destination: &o.compressed,
+		},
+		cli.BoolFlag{
+			Name:        "raw",
+			Usage:       "Write the response body as received, without decoding it",
+			Destination: &o.raw,
+		},
+		cli.StringFlag{
+			Name:        "write-out, w",
+			Usage:       "Output the given template after the transfer, using %{variable} for the transfer details",
+			Destination: &o.writeOut,
+		},
+		cli.StringFlag{
+			Name:        "json-report",
+			Usage:       "Append a JSON report of every transfer to this file, - for stderr",
+			Destination: &o.jsonReport,
+		},
+		cli.StringFlag{
+			Name:        "har",
+			Usage:       "Record every request and response in this HAR file",
+			Destination: &o.har,
+		},
+		cli.IntFlag{
+			Name:        "har-max-body",
+			Usage:       "Capture up to this many bytes of the bodies in the HAR file",
+			Destination: &o.harMaxBody,
+		},
 	}
 }
 
@@ -190,12 +576,19 @@ func (o *Options) checkRedirect(req *http.Request, via []*http.Request) error {
 
 	resp := req.Response
 
-	if !o.followRedirect || o.redirectsTaken >= o.maxRedirects {
+	if !o.followRedirect {
 		return http.ErrUseLastResponse
 	}
+	if o.redirectsTaken > o.maxRedirects {
+		return fmt.Errorf("%w (%d)", errTooManyRedirects, o.maxRedirects)
+	}
 
-	if resp != nil {
-		fmt.Fprintf(Incoming, "%s %s\n", resp.Proto, resp.Status)
+	if s := statsFromContext(req.Context()); s != nil {
+		s.redirect(req)
+	}
+
+	if resp != nil && o.verbose {
+		fmt.Fprintf(Incoming, "%s %s\n", protoName(resp), resp.Status)
 
 		for k, v := range resp.Header {
 			fmt.Fprintln(Incoming, k, v)
@@ -222,15 +615,32 @@ func (opts *Options) BuildCommonOptions(c *cli.Context) error {
 	opts.dataRaw = c.StringSlice("data-raw")
 	opts.dataURLEncode = c.StringSlice("data-urlencode")
 	opts.form = c.StringSlice("form")
+	opts.resolve = c.StringSlice("resolve")
+	opts.connectTo = c.StringSlice("connect-to")
+
+	var err error
+	if opts.writeOut, err = readWriteOut(opts.writeOut); err != nil {
+		return err
+	}
+
+	if opts.limitRate != "" {
+		if opts.rateLimit, err = parseRate(opts.limitRate); err != nil {
+			return err
+		}
+	}
+
+	if opts.parallel && opts.parallelMax == 0 {
+		return errors.New("--parallel-max must be at least 1")
+	}
 
-	// If verbose set the logs writers
-	if opts.verbose {
-		Incoming.(*LogWriter).SetOutput(os.Stderr)
-		Outgoing.(*LogWriter).SetOutput(os.Stderr)
+	if opts.fail && opts.failWithBody {
+		return errors.New("--fail and --fail-with-body can't be used together")
 	}
 
 	// Process form data or url-encoded data
-	opts.ProcessData()
+	if err := opts.ProcessData(); err != nil {
+		return err
+	}
 	d, err := opts.ProcessFormData()
 	if err != nil {
 		return err
@@ -240,38 +650,54 @@ func (opts *Options) BuildCommonOptions(c *cli.Context) error {
 	}
 	opts.fdata = d
 
-	// Set the request method if Head option is specified
+	// Set the request method if Head option is specified, the headers
+	// being the output
 	if opts.head {
 		opts.method = "HEAD"
-		Incoming = io.MultiWriter(os.Stdout, Incoming.(*LogWriter))
-	}
-
-	// Start the timer
-	if opts.maxTime > 0 {
-		maxTime(opts.maxTime)
+		opts.include = true
 	}
 
 	return nil
 }
 
+// targetOptions are the options specific to the transfer of one URL, which
+// every transfer gets its own copy of.
+type targetOptions struct {
+	method         string
+	headers        []string
+	outputFilename string
+	body           io.Reader
+}
+
 // BuildTargetSpecificOptions function is used to build the options specific to a given URL target.
-// This has to run for every URL separately.
-func (opts *Options) BuildTargetSpecificOptions(target string) (io.Reader, error) {
-	var body io.Reader
+// This has to run for every URL separately, and for every attempt at its transfer, as the body
+// is read by the request. The common options are left untouched, so that the transfers can run
+// in parallel.
+func (opts *Options) BuildTargetSpecificOptions(target globbedURL) (*targetOptions, error) {
+	t := &targetOptions{
+		method:         opts.method,
+		headers:        append([]string(nil), opts.headers...),
+		outputFilename: expandOutput(opts.outputFilename, target.values),
+	}
 	// Set the output filename from the remote URL, if -O is passed.
 	if opts.remoteName {
-		opts.outputFilename = path.Base(target)
+		t.outputFilename = path.Base(target.url)
 	}
 
 	// Initialize the file upload if specified.
 	if opts.fileUpload != "" {
-		body = opts.uploadFile()
+		t.method = http.MethodPut
+		t.headers = append(t.headers, "Expect: 100-continue")
+		var err error
+		if t.body, err = opts.uploadFile(); err != nil {
+			return nil, err
+		}
 	}
 
 	// Process headers and post data
 	if len(opts.data) > 0 || len(opts.fdata) > 0 {
 		var data bytes.Buffer
-		opts.method = "POST"
+		t.method = "POST"
 
 		header := ""
 
@@ -290,21 +716,21 @@ func (opts *Options) BuildTargetSpecificOptions(target string) (io.Reader, error
 			for key, field := range opts.fdata {
 				err := writeToMultipart(w, key, field)
 				if err != nil {
-					return nil, fmt.Errorf("unable to create http request; %s\n", err)
+					return nil, withExitCode(exitReadError, fmt.Errorf("unable to create http request; %w", err))
 				}
 			}
 			w.Close()
 			header = "Content-Type: " + w.FormDataContentType()
 		}
 
-		opts.headers = append(opts.headers, header)
-		body = &data
+		t.headers = append(t.headers, header)
+		t.body = &data
 	}
 
-	return body, nil
+	return t, nil
 }
 
-func (o *Options) ProcessData() {
+func (o *Options) ProcessData() error {
 	var uriEncodes url.Values
 	for _, d := range o.dataAscii {
 		parts := strings.SplitN(d, "=", 2)
@@ -315,7 +741,7 @@ func (o *Options) ProcessData() {
 		if strings.HasPrefix(parts[1], "@") {
 			data, err := ioutil.ReadFile(strings.TrimPrefix(parts[1], "@"))
 			if err != nil {
-				Status.Fatalf("Unable to read file %s for data element %s\n", strings.TrimPrefix(parts[1], "@"), parts[0])
+				return withExitCode(exitReadError, fmt.Errorf("unable to read file %s for data element %s; %w", strings.TrimPrefix(parts[1], "@"), parts[0], err))
 			}
 			data = []byte(strings.Replace(string(data), "\r", "", -1))
 			data = []byte(strings.Replace(string(data), "\n", "", -1))
@@ -339,39 +765,32 @@ func (o *Options) ProcessData() {
 	if len(uriEncodes) > 0 {
 		o.data = append(o.data, uriEncodes.Encode())
 	}
+	return nil
 }
 
-func (o *Options) openOutputFile() *os.File {
-	var err error
-	var outputFile *os.File
-	if o.outputFilename != "" {
-		if outputFile, err = os.OpenFile(o.outputFilename, os.O_CREATE|os.O_RDWR, 0666); err != nil {
-			Status.Fatalf("Error: Unable to create/open file '%s' for output\n", o.outputFilename)
-		}
-	} else {
-		outputFile = os.Stdout
+func (t *targetOptions) openOutputFile() (*os.File, error) {
+	if t.outputFilename == "" {
+		return os.Stdout, nil
 	}
-	return outputFile
-}
-
-func (o *Options) uploadFile() io.Reader {
-	o.method = "PUT"
-
-	tr := &http.Transport{
-		ExpectContinueTimeout: time.Duration(o.expectTimeout) * time.Second,
+	outputFile, err := os.OpenFile(t.outputFilename, os.O_CREATE|os.O_RDWR, 0666)
+	if err != nil {
+		return nil, withExitCode(exitWriteError, fmt.Errorf("unable to create/open file '%s' for output; %w", t.outputFilename, err))
 	}
-	client.Transport = tr
-	o.headers = append(o.headers, "Expect: 100-continue")
+	return outputFile, nil
+}
 
+func (o *Options) uploadFile() (io.Reader, error) {
 	reader, err := os.Open(o.fileUpload)
 	if err != nil {
-		Status.Fatalf("Error opening %s\n", o.fileUpload)
+		return nil, withExitCode(exitReadError, fmt.Errorf("unable to open %s; %w", o.fileUpload, err))
 	}
 
-	if !o.silent {
+	// With --parallel, the progress is shown by the progress meter of all the
+	// transfers.
+	if !o.silent && !o.parallel {
 		fi, err := reader.Stat()
 		if err != nil {
-			Status.Fatalf("Unable to get file stats for %v\n", o.fileUpload)
+			return nil, withExitCode(exitReadError, fmt.Errorf("unable to get file stats for %v; %w", o.fileUpload, err))
 		}
 		return &ioprogress.Reader{
 			Reader: reader,
@@ -382,10 +801,10 @@ func (o *Options) uploadFile() io.Reader {
 					(ioprogress.DrawTextFormatBarWithIndicator(40, '>'))(progress, total),
 					ioprogress.DrawTextFormatBytes(progress, total))
 			}),
-		}
+		}, nil
 	}
 
-	return reader
+	return reader, nil
 }
 
 // ProcessFormData is used to parse the form data passed as commandline arguments.
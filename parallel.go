@@ -0,0 +1,38 @@
+package main
+
+import (
+	"io"
+	"sync"
+)
+
+// runParallel runs the n transfers, calling transfer with their index, at
+// most --parallel-max at a time, and returns once they are all done.
+func (o *Options) runParallel(n int, transfer func(int)) {
+	slots := make(chan struct{}, o.parallelMax)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(i int) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			transfer(i)
+		}(i)
+	}
+	wg.Wait()
+}
+
+// lockedWriter serializes the writes of the parallel transfers to a shared
+// destination, like the --dump-header file.
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (w *lockedWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.w.Write(p)
+}
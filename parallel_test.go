@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRunParallel(t *testing.T) {
+	t.Log("Testing runParallel()... (expecting every transfer, at most --parallel-max at a time)")
+
+	var running, most, ran int32
+	opts := Options{parallelMax: 2}
+	opts.runParallel(6, func(i int) {
+		n := atomic.AddInt32(&running, 1)
+		for {
+			m := atomic.LoadInt32(&most)
+			if n <= m || atomic.CompareAndSwapInt32(&most, m, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		atomic.AddInt32(&running, -1)
+		atomic.AddInt32(&ran, 1)
+	})
+	if ran != 6 || most != 2 {
+		t.Errorf("Expected 6 transfers, 2 at a time, but got %d, %d at a time", ran, most)
+	}
+}
+
+func TestParallelTransfers(t *testing.T) {
+	t.Log("Testing fetchWithRetries() in parallel... (expecting every transfer to keep its own options)")
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Method + " " + r.URL.Path + " " + r.Header.Get("X-Test")))
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	urls, _ := expandGlob(srv.URL + "/[1-8]")
+	opts := Options{method: "GET", silent: true, parallel: true, parallelMax: 4,
+		outputFilename: filepath.Join(dir, "out#1"), headers: []string{"X-Test: yes"}, data: []string{"a=b"}}
+	var mu sync.Mutex
+	var failed []error
+	opts.runParallel(len(urls), func(i int) {
+		if err := fetchWithRetries(urls[i], opts, newTransferStats(i)); err != nil {
+			mu.Lock()
+			failed = append(failed, err)
+			mu.Unlock()
+		}
+	})
+	if len(failed) > 0 {
+		t.Fatalf("Expected the transfers to succeed, but got %v", failed)
+	}
+	for i, u := range urls {
+		body, _ := ioutil.ReadFile(filepath.Join(dir, "out"+u.values[0]))
+		if expected := "POST /" + u.values[0] + " yes"; string(body) != expected {
+			t.Errorf("Expected %q for transfer %d, but got %q", expected, i, body)
+		}
+	}
+	if len(opts.headers) != 1 || opts.method != "GET" {
+		t.Errorf("Expected the common options to be untouched, but got %v and %s", opts.headers, opts.method)
+	}
+}
+
+func TestProgressMeter(t *testing.T) {
+	t.Log("Testing progressMeter... (expecting a line per running transfer and a summary)")
+
+	var out bytes.Buffer
+	m := &progressMeter{w: &out, tty: true, start: time.Now(), total: 2}
+	done, running := newTransferStats(0), newTransferStats(1)
+	done.downloaded = 2048
+	running.downloaded, running.uploaded = 512, 100
+	m.remove(m.add("http://example.com/done", done))
+	m.add("http://example.com/running", running).setDownload(1024)
+	m.draw()
+	m.Write([]byte("message\n"))
+
+	lines := strings.Split(out.String(), "\n")
+	if !strings.HasPrefix(lines[0], "http://example.com/running") || !strings.Contains(lines[0], "[==========          ]  50% 512B/1.0KiB up 100B") {
+		t.Errorf("Unexpected transfer line %q", lines[0])
+	}
+	if !strings.HasPrefix(lines[1], "1/2 done, 1 running, 2.5KiB received, 100B sent") {
+		t.Errorf("Unexpected summary line %q", lines[1])
+	}
+	if lines[2] != "\x1b[2A\x1b[Jmessage" {
+		t.Errorf("Expected the meter to be erased before a message, but got %q", lines[2])
+	}
+}
+
+func TestProgressMeterPlain(t *testing.T) {
+	t.Log("Testing progressMeter without a terminal... (expecting a plain summary line per transfer)")
+
+	var out bytes.Buffer
+	m := newProgressMeter(&out, 2)
+	for i := 0; i < 2; i++ {
+		stats := newTransferStats(i)
+		stats.downloaded = 1024
+		b := m.add("http://example.com/", stats)
+		m.draw()
+		m.Write([]byte("message\n"))
+		m.remove(b)
+	}
+	m.stop()
+
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if strings.Contains(out.String(), "\x1b") || len(lines) != 4 {
+		t.Fatalf("Expected plain lines, but got %q", out.String())
+	}
+	if lines[0] != "message" || !strings.HasPrefix(lines[3], "2/2 done, 0 running, 2.0KiB received") {
+		t.Errorf("Unexpected lines %q", lines)
+	}
+}
+
+func TestParallelExitCode(t *testing.T) {
+	t.Log("Testing run() with --parallel... (expecting the exit code of the last failed transfer of the command line)")
+
+	setProxyEnv(t, nil)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The first transfer fails last.
+		time.Sleep(200 * time.Millisecond)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer srv.Close()
+
+	opts := &Options{method: "GET", silent: true, fail: true, parallel: true, parallelMax: 2,
+		outputFilename: filepath.Join(t.TempDir(), "out")}
+	err := run([]urlGroup{{opts, []string{srv.URL, "http://127.0.0.1:1/"}}})
+	if code := exitCodeFor(err); code != exitConnect {
+		t.Errorf("Expected exit code %d, but got %d (%v)", exitConnect, code, err)
+	}
+}
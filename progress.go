@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// progressMeter draws the progress of the parallel transfers, one line per
+// running transfer and a summary line, redrawn in place. It replaces the
+// progress bars of the transfers, which would overwrite each other. The
+// messages written to it are printed above. When w isn't a terminal, only the
+// summary is written, as a plain line after every transfer.
+type progressMeter struct {
+	mu    sync.Mutex
+	w     io.Writer
+	tty   bool
+	start time.Time
+	total int            // the number of transfers
+	bars  []*progressBar // the running transfers
+	done  int
+	lines int // the height of the last drawing
+
+	// The bytes of the finished transfers.
+	doneDown, doneUp int64
+
+	stopped chan struct{}
+	wg      sync.WaitGroup
+}
+
+// progressBar is the line of a transfer in the progress meter.
+type progressBar struct {
+	name  string
+	stats *transferStats
+	// The sizes of the bodies, when known, set atomically.
+	downTotal, upTotal int64
+}
+
+// newProgressMeter starts drawing the progress of total transfers to w.
+func newProgressMeter(w io.Writer, total int) *progressMeter {
+	m := &progressMeter{w: w, tty: isTerminal(w), start: time.Now(), total: total, stopped: make(chan struct{})}
+	if !m.tty {
+		return m
+	}
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		ticker := time.NewTicker(200 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-m.stopped:
+				return
+			case <-ticker.C:
+				m.draw()
+			}
+		}
+	}()
+	return m
+}
+
+// add returns the line of a transfer which starts.
+func (m *progressMeter) add(name string, stats *transferStats) *progressBar {
+	if m == nil {
+		return nil
+	}
+	b := &progressBar{name: name, stats: stats, downTotal: -1, upTotal: -1}
+	m.mu.Lock()
+	m.bars = append(m.bars, b)
+	m.mu.Unlock()
+	return b
+}
+
+// remove removes the line of a transfer which is done.
+func (m *progressMeter) remove(b *progressBar) {
+	if m == nil || b == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, bar := range m.bars {
+		if bar == b {
+			m.bars = append(m.bars[:i], m.bars[i+1:]...)
+			break
+		}
+	}
+	m.done++
+	m.doneDown += atomic.LoadInt64(&b.stats.downloaded)
+	m.doneUp += atomic.LoadInt64(&b.stats.uploaded)
+	if !m.tty {
+		fmt.Fprintln(m.w, m.summary())
+	}
+}
+
+// stop stops the redrawing, leaving the final summary.
+func (m *progressMeter) stop() {
+	if m == nil {
+		return
+	}
+	close(m.stopped)
+	m.wg.Wait()
+	m.draw()
+}
+
+// Write prints p above the progress meter.
+func (m *progressMeter) Write(p []byte) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.clear()
+	return m.w.Write(p)
+}
+
+// clear erases the last drawing. The caller holds m.mu.
+func (m *progressMeter) clear() {
+	if m.lines > 0 {
+		fmt.Fprintf(m.w, "\x1b[%dA\x1b[J", m.lines)
+		m.lines = 0
+	}
+}
+
+func (m *progressMeter) draw() {
+	if !m.tty {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var b strings.Builder
+	for _, bar := range m.bars {
+		b.WriteString(bar.line())
+		b.WriteByte('\n')
+	}
+	b.WriteString(m.summary())
+	b.WriteByte('\n')
+	m.clear()
+	io.WriteString(m.w, b.String())
+	m.lines = len(m.bars) + 1
+}
+
+// summary describes all the transfers. The caller holds m.mu.
+func (m *progressMeter) summary() string {
+	down, up := m.doneDown, m.doneUp
+	for _, bar := range m.bars {
+		down += atomic.LoadInt64(&bar.stats.downloaded)
+		up += atomic.LoadInt64(&bar.stats.uploaded)
+	}
+	speed := int64(float64(down+up) / time.Since(m.start).Seconds())
+	return fmt.Sprintf("%d/%d done, %d running, %s received, %s sent, %s/s",
+		m.done, m.total, len(m.bars), formatSize(down), formatSize(up), formatSize(speed))
+}
+
+// setDownload sets the size of the response body, -1 if unknown.
+func (b *progressBar) setDownload(size int64) {
+	if b != nil {
+		atomic.StoreInt64(&b.downTotal, size)
+	}
+}
+
+// setUpload sets the size of the request body, -1 if unknown.
+func (b *progressBar) setUpload(size int64) {
+	if b != nil {
+		atomic.StoreInt64(&b.upTotal, size)
+	}
+}
+
+func (b *progressBar) line() string {
+	name := b.name
+	if len(name) > 40 {
+		name = "..." + name[len(name)-37:]
+	}
+	line := fmt.Sprintf("%-40s ", name)
+
+	down, total := atomic.LoadInt64(&b.stats.downloaded), atomic.LoadInt64(&b.downTotal)
+	if total > 0 && down <= total {
+		line += fmt.Sprintf("[%-20s] %3d%% %s/%s", strings.Repeat("=", int(down*20/total)), down*100/total,
+			formatSize(down), formatSize(total))
+	} else {
+		line += formatSize(down)
+	}
+
+	if up := atomic.LoadInt64(&b.stats.uploaded); up > 0 {
+		line += " up " + formatSize(up)
+		if total := atomic.LoadInt64(&b.upTotal); total > 0 {
+			line += "/" + formatSize(total)
+		}
+	}
+	return line
+}
+
+// isTerminal tells whether w is a terminal, where the meter can be redrawn.
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// formatSize formats a number of bytes with the binary units.
+func formatSize(n int64) string {
+	if n < 1024 {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(1024), 0
+	for m := n / 1024; m >= 1024 && exp < 5; m /= 1024 {
+		div *= 1024
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+
+	"golang.org/x/net/http2"
+)
+
+// httpVersion applies the HTTP version options to the transport, returning
+// the round tripper to use for the transfers.
+func (o *Options) httpVersion(tr *http.Transport, d *dialer) http.RoundTripper {
+	switch {
+	case o.priorKnowledge:
+		// Over TLS, only offer HTTP/2 during the ALPN negotiation.
+		tr.TLSClientConfig.NextProtos = []string{http2.NextProtoTLS}
+		return &h2cTransport{
+			tr: tr,
+			h2c: &http2.Transport{
+				AllowHTTP: true,
+				DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+					return d.DialContext(ctx, network, addr)
+				},
+			},
+		}
+	case o.http2:
+		tr.ForceAttemptHTTP2 = true
+	case o.http11:
+		tr.ForceAttemptHTTP2 = false
+		tr.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	case o.http10:
+		return &http10Transport{tr: tr, d: d}
+	}
+	return tr
+}
+
+// h2cTransport sends the requests for http:// URLs using cleartext HTTP/2
+// right away, without any upgrade (prior knowledge). The other requests go
+// through tr.
+type h2cTransport struct {
+	tr  *http.Transport
+	h2c *http2.Transport
+}
+
+func (t *h2cTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ts := tracerFromContext(req.Context())
+	if req.URL.Scheme != "http" {
+		if ts != nil {
+			ts.forceProto = ""
+		}
+		return t.tr.RoundTrip(req)
+	}
+	if ts != nil {
+		ts.forceProto = "HTTP/2"
+	}
+	return t.h2c.RoundTrip(req)
+}
+
+// http10Transport sends the requests as HTTP/1.0, which the standard
+// transport can't do, over a new connection for every request. The
+// connections are still opened by d, the dialer of tr.
+type http10Transport struct {
+	tr *http.Transport
+	d  *dialer
+}
+
+func (t *http10Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	trace := httptrace.ContextClientTrace(ctx)
+	if ts := tracerFromContext(ctx); ts != nil {
+		ts.forceProto = "HTTP/1.0"
+	}
+
+	var conn net.Conn
+	var proxied bool
+	var err error
+	addr := canonicalAddr(req.URL)
+	if req.URL.Scheme == "https" {
+		// Through the HTTP proxy, if any, with a CONNECT tunnel.
+		cfg := t.tr.TLSClientConfig.Clone()
+		cfg.ServerName = req.URL.Hostname()
+		cfg.NextProtos = nil
+		conn, err = t.d.dialTLSConn(ctx, addr, cfg, t.tr.TLSHandshakeTimeout)
+	} else {
+		if t.tr.Proxy != nil {
+			p, err := t.tr.Proxy(req)
+			if err != nil {
+				return nil, err
+			}
+			if p != nil {
+				proxied = true
+				addr = canonicalAddr(p)
+			}
+		}
+		conn, err = t.tr.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if trace != nil && trace.GotConn != nil {
+		trace.GotConn(httptrace.GotConnInfo{Conn: conn})
+	}
+
+	if err := writeHTTP10Request(conn, req, proxied); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if trace != nil && trace.WroteRequest != nil {
+		trace.WroteRequest(httptrace.WroteRequestInfo{})
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if trace != nil && trace.GotFirstResponseByte != nil {
+		trace.GotFirstResponseByte()
+	}
+	resp.TLS = connTLSState(conn)
+	resp.Body = &connClosingBody{ReadCloser: resp.Body, conn: conn}
+	return resp, nil
+}
+
+// writeHTTP10Request writes req on w with an HTTP/1.0 request line. Proxied
+// requests use the absolute URL as the request target. The connection is
+// never reused, which "Connection: close" tells the server.
+func writeHTTP10Request(w io.Writer, req *http.Request, proxied bool) error {
+	target := req.URL.RequestURI()
+	if proxied {
+		target = req.URL.String()
+	}
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+
+	body := req.Body
+	contentLength := req.ContentLength
+	if body != nil && contentLength <= 0 {
+		// HTTP/1.0 has no chunked encoding, the length must be known.
+		data, err := ioutil.ReadAll(body)
+		if err != nil {
+			return err
+		}
+		body.Close()
+		body = ioutil.NopCloser(bytes.NewReader(data))
+		contentLength = int64(len(data))
+	}
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "%s %s HTTP/1.0\r\n", req.Method, target)
+	fmt.Fprintf(bw, "Host: %s\r\n", host)
+
+	header := req.Header.Clone()
+	header.Del("Host")
+	header.Del("Expect")
+	header.Set("Connection", "close")
+	if body != nil {
+		header.Set("Content-Length", strconv.FormatInt(contentLength, 10))
+	}
+	if err := header.Write(bw); err != nil {
+		return err
+	}
+	if _, err := bw.WriteString("\r\n"); err != nil {
+		return err
+	}
+
+	if trace := httptrace.ContextClientTrace(req.Context()); trace != nil && trace.WroteHeaders != nil {
+		trace.WroteHeaders()
+	}
+
+	if body != nil {
+		defer body.Close()
+		if _, err := io.Copy(bw, body); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// connClosingBody closes the connection of an HTTP/1.0 response along with
+// its body.
+type connClosingBody struct {
+	io.ReadCloser
+	conn net.Conn
+}
+
+func (b *connClosingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.conn.Close()
+	return err
+}
+
+// protoName returns the protocol of resp the way cURL prints it, "HTTP/2"
+// rather than "HTTP/2.0".
+func protoName(resp *http.Response) string {
+	if resp.ProtoMajor >= 2 {
+		return "HTTP/" + strconv.Itoa(resp.ProtoMajor)
+	}
+	return resp.Proto
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+func TestHTTP10(t *testing.T) {
+	t.Log("Testing --http1.0... (expecting an HTTP/1.0 request line and Connection: close)")
+
+	setProxyEnv(t, nil)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	received := make(chan []string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := textproto.NewReader(bufio.NewReader(conn))
+		var lines []string
+		for {
+			line, err := r.ReadLine()
+			if err != nil || line == "" {
+				break
+			}
+			lines = append(lines, line)
+		}
+		received <- lines
+		conn.Write([]byte("HTTP/1.0 200 OK\r\nContent-Length: 2\r\n\r\nok"))
+	}()
+
+	tr, err := (&Options{http10: true}).newTransport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := (&http.Client{Transport: tr}).Get("http://" + l.Addr().String() + "/path?q=1")
+	if err != nil {
+		t.Fatalf("Expected the request to succeed, but got %s", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "ok" {
+		t.Errorf("Expected ok, but got %q", body)
+	}
+
+	lines := <-received
+	if len(lines) == 0 || lines[0] != "GET /path?q=1 HTTP/1.0" {
+		t.Errorf("Expected an HTTP/1.0 request line, but got %q", lines)
+	}
+	if !strings.Contains(strings.Join(lines, "\n"), "\nConnection: close") {
+		t.Errorf("Expected Connection: close, but got %q", lines)
+	}
+}
+
+func TestHTTP10HandshakeTimeout(t *testing.T) {
+	t.Log("Testing --http1.0 with --connect-timeout... (expecting the TLS handshake to time out)")
+
+	setProxyEnv(t, nil)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		// Accept the connection, but never answer the handshake.
+		conn, err := l.Accept()
+		if err == nil {
+			defer conn.Close()
+			time.Sleep(5 * time.Second)
+		}
+	}()
+
+	tr, err := (&Options{http10: true, connectTimeout: 1}).newTransport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	_, err = (&http.Client{Transport: tr}).Get("https://" + l.Addr().String() + "/")
+	if err == nil || classifyError(err) != "timeout" {
+		t.Errorf("Expected a timeout, but got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("Expected the handshake to be aborted after 1s, but it took %s", elapsed)
+	}
+}
+
+func TestHTTP11(t *testing.T) {
+	t.Log("Testing --http1.1... (expecting HTTP/1.1 with a server offering HTTP/2)")
+
+	setProxyEnv(t, nil)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	for _, c := range []struct {
+		opts     Options
+		expected string
+	}{
+		{Options{insecure: true}, "HTTP/2.0"},
+		{Options{insecure: true, http11: true}, "HTTP/1.1"},
+	} {
+		tr, err := c.opts.newTransport()
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := (&http.Client{Transport: tr}).Get(srv.URL)
+		if err != nil {
+			t.Fatalf("Expected the request to succeed, but got %s", err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != c.expected || resp.Proto != c.expected {
+			t.Errorf("Expected %s, but got %s (server) and %s (client)", c.expected, body, resp.Proto)
+		}
+	}
+}
+
+func TestPriorKnowledge(t *testing.T) {
+	t.Log("Testing --http2-prior-knowledge... (expecting cleartext HTTP/2 without upgrade)")
+
+	setProxyEnv(t, nil)
+	srv := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "" {
+			t.Errorf("Expected no upgrade, but got %q", r.Header.Get("Upgrade"))
+		}
+		w.Write([]byte(r.Proto))
+	}), &http2.Server{}))
+	defer srv.Close()
+
+	tr, err := (&Options{priorKnowledge: true}).newTransport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := (&http.Client{Transport: tr}).Get(srv.URL)
+	if err != nil {
+		t.Fatalf("Expected the request to succeed, but got %s", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "HTTP/2.0" || resp.ProtoMajor != 2 {
+		t.Errorf("Expected HTTP/2.0, but got %s (server) and %s (client)", body, resp.Proto)
+	}
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/idna"
+)
+
+// proxySettings holds the proxies to use for each URL scheme, along with the
+// hosts which have to be reached directly.
+type proxySettings struct {
+	http    *url.URL
+	https   *url.URL
+	noProxy []string
+}
+
+// proxySettings builds the proxy settings from the standard environment
+// variables (http_proxy, HTTPS_PROXY, ALL_PROXY, NO_PROXY in upper or lower
+// case) and the command line, which always takes precedence.
+func (o *Options) proxySettings() (*proxySettings, error) {
+	httpProxy := getEnvAny("http_proxy", "HTTP_PROXY")
+	httpsProxy := getEnvAny("https_proxy", "HTTPS_PROXY")
+	if all := getEnvAny("all_proxy", "ALL_PROXY"); all != "" {
+		if httpProxy == "" {
+			httpProxy = all
+		}
+		if httpsProxy == "" {
+			httpsProxy = all
+		}
+	}
+
+	proxy := o.proxy
+	switch {
+	case o.socks5Hostname != "":
+		proxy = "socks5h://" + o.socks5Hostname
+	case o.socks5 != "":
+		proxy = "socks5://" + o.socks5
+	}
+	if proxy != "" {
+		httpProxy = proxy
+		httpsProxy = proxy
+	}
+
+	noProxy := getEnvAny("no_proxy", "NO_PROXY")
+	if o.noProxy != "" {
+		noProxy = o.noProxy
+	}
+
+	var err error
+	ps := &proxySettings{}
+	if httpProxy != "" {
+		if ps.http, err = parseProxy(httpProxy); err != nil {
+			return nil, err
+		}
+	}
+	if httpsProxy != "" {
+		if ps.https, err = parseProxy(httpsProxy); err != nil {
+			return nil, err
+		}
+	}
+	for _, h := range strings.Split(noProxy, ",") {
+		if h = strings.ToLower(strings.TrimSpace(h)); h != "" {
+			ps.noProxy = append(ps.noProxy, h)
+		}
+	}
+	return ps, nil
+}
+
+// bypass reports whether host has to be reached without a proxy. As in cURL,
+// a no-proxy entry matches the host itself and all its sub-domains, an IP
+// range can be given in CIDR notation and a single "*" matches every host.
+func (ps *proxySettings) bypass(host string) bool {
+	host = strings.ToLower(host)
+	for _, np := range ps.noProxy {
+		if np == "*" {
+			return true
+		}
+		if _, ipNet, err := net.ParseCIDR(np); err == nil {
+			if ip := net.ParseIP(host); ip != nil && ipNet.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		np = strings.TrimPrefix(np, ".")
+		if host == np || strings.HasSuffix(host, "."+np) {
+			return true
+		}
+	}
+	return false
+}
+
+// socks reports whether one of the proxies is a SOCKS proxy.
+func (ps *proxySettings) socks() bool {
+	return (ps.http != nil && isSocksScheme(ps.http.Scheme)) ||
+		(ps.https != nil && isSocksScheme(ps.https.Scheme))
+}
+
+// proxyRouter picks the proxy to use for every request. HTTP proxies are
+// handed over to the transport, while SOCKS proxies are passed to the dialer
+// in the context of the request by socksTransport. With tunnel set, the
+// dialer opens the tunnels through the HTTP proxies for the https:// URLs
+// itself.
+type proxyRouter struct {
+	settings *proxySettings
+	user     string
+	verbose  bool
+	tunnel   bool
+}
+
+func (o *Options) newProxyRouter() (*proxyRouter, error) {
+	ps, err := o.proxySettings()
+	if err != nil {
+		return nil, err
+	}
+
+	return &proxyRouter{
+		settings: ps,
+		user:     o.proxyUser,
+		verbose:  o.verbose,
+	}, nil
+}
+
+// route returns the proxy, HTTP or SOCKS, to use to reach u, if any.
+func (r *proxyRouter) route(u *url.URL) *url.URL {
+	p := r.settings.http
+	if u.Scheme == "https" {
+		p = r.settings.https
+	}
+	if p == nil || r.settings.bypass(u.Hostname()) {
+		return nil
+	}
+
+	// Hand a copy to the transport so the credentials can be set safely.
+	pu := *p
+	if r.user != "" {
+		user, pass, _ := strings.Cut(r.user, ":")
+		pu.User = url.UserPassword(user, pass)
+	}
+	return &pu
+}
+
+// Proxy is used as the Proxy function of the transport.
+func (r *proxyRouter) Proxy(req *http.Request) (*url.URL, error) {
+	if r.tunnel && req.URL.Scheme == "https" {
+		return nil, nil
+	}
+	if p := r.route(req.URL); p != nil && !isSocksScheme(p.Scheme) {
+		return p, nil
+	}
+	return nil, nil
+}
+
+type socksKey struct{}
+
+// socksTransport passes the SOCKS proxy to use for every request, redirects
+// included, to the dialer through the context of the request. The transport
+// pools the connections by scheme and address, which are enough to tell the
+// proxy they go through, the proxy settings being the same for all the
+// requests.
+type socksTransport struct {
+	http.RoundTripper
+	router *proxyRouter
+}
+
+func (t *socksTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if p := t.router.route(req.URL); p != nil && isSocksScheme(p.Scheme) {
+		req = req.WithContext(context.WithValue(req.Context(), socksKey{}, p))
+	}
+	return t.RoundTripper.RoundTrip(req)
+}
+
+// socksProxyFromContext returns the SOCKS proxy of the request being dialed,
+// if any.
+func socksProxyFromContext(ctx context.Context) *url.URL {
+	p, _ := ctx.Value(socksKey{}).(*url.URL)
+	return p
+}
+
+// tunnelProxy returns the HTTP proxy to tunnel through to reach addr over
+// TLS, if any. The proxy itself, when it is an HTTPS one, is reached
+// directly.
+func (d *dialer) tunnelProxy(addr string) *url.URL {
+	if d.unixSocket != "" {
+		return nil
+	}
+	p := d.router.route(&url.URL{Scheme: "https", Host: addr})
+	if p == nil || isSocksScheme(p.Scheme) || canonicalAddr(p) == addr {
+		return nil
+	}
+	return p
+}
+
+// tunnel is a connection to a TLS server through an HTTP proxy, with the
+// trace and the header capture of its CONNECT exchange, if any.
+type tunnel struct {
+	net.Conn // to the proxy, TLS is started over it
+	trace    *traceConn
+	wire     *wireConn
+}
+
+// dialTunnel connects to addr through the HTTP proxy p with a CONNECT
+// request. The transport does so itself unless the TLS connections are
+// opened by dialTLS, but then starts TLS out of reach of the trace and of the
+// header capture. cfg and timeout are the ones of the TLS connection to the
+// server, also used for an HTTPS proxy.
+func (d *dialer) dialTunnel(ctx context.Context, p *url.URL, addr string, cfg *tls.Config, timeout time.Duration) (_ *tunnel, err error) {
+	conn, err := d.dial(ctx, "tcp", canonicalAddr(p))
+	if err != nil {
+		return nil, &net.OpError{Op: "proxyconnect", Net: "tcp", Err: err}
+	}
+	defer func() {
+		if err != nil {
+			conn.Close()
+			err = &net.OpError{Op: "proxyconnect", Net: "tcp", Err: err}
+		}
+	}()
+
+	if p.Scheme == "https" {
+		pcfg := cfg.Clone()
+		pcfg.ServerName = p.Hostname()
+		pcfg.NextProtos = nil
+		tlsConn := tls.Client(conn, pcfg)
+		if err := tlsHandshake(ctx, tlsConn, timeout); err != nil {
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	t := &tunnel{Conn: conn}
+	rw := conn
+	if d.trace != nil {
+		t.trace = d.trace.newConn(conn)
+		rw = t.trace
+	}
+	if d.wire {
+		t.wire = newWireConn(rw)
+		rw = t.wire
+	}
+
+	// The exchange is aborted along with the transfer.
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if p.User != nil {
+		pass, _ := p.User.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+encodeToBase64(p.User.Username()+":"+pass))
+	}
+	if err := req.Write(rw); err != nil {
+		return nil, err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(rw), req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	resp.Body.Close()
+
+	if d.verbose {
+		traceProxyConnect(ctx, p, req, resp)
+	}
+	if resp.StatusCode != http.StatusOK {
+		_, text, _ := strings.Cut(resp.Status, " ")
+		return nil, errors.New(text)
+	}
+	return t, nil
+}
+
+// wrap returns conn, the TLS connection started over the tunnel, traced and
+// captured as a continuation of the CONNECT exchange.
+func (t *tunnel) wrap(conn net.Conn) net.Conn {
+	if t.trace != nil {
+		conn = t.trace.decrypted(conn)
+	}
+	if t.wire != nil {
+		w := newWireConn(conn)
+		w.pending = t.wire.pending
+		conn = w
+	}
+	return conn
+}
+
+// parseProxy parses a proxy string the way cURL does : when no scheme is
+// given, the proxy is assumed to be a plain HTTP proxy.
+func parseProxy(raw string) (*url.URL, error) {
+	if !strings.Contains(raw, "://") {
+		raw = "http://" + raw
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid proxy %q", raw)
+	}
+
+	switch {
+	case u.Scheme == "http", u.Scheme == "https":
+	case isSocksScheme(u.Scheme):
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q", u.Scheme)
+	}
+	return u, nil
+}
+
+// canonicalAddr returns the host:port the transport dials for u.
+func canonicalAddr(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	host := u.Hostname()
+	if h, err := idna.Lookup.ToASCII(host); err == nil {
+		host = h
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// traceProxyConnect logs the CONNECT exchange used to tunnel through an HTTP
+// proxy, the same way the regular request and response are logged.
+func traceProxyConnect(ctx context.Context, proxyURL *url.URL, req *http.Request, resp *http.Response) error {
+	Status.Printf(" Establish HTTP proxy tunnel to %s\n", req.Host)
+
+	fmt.Fprintln(Outgoing, req.Method, req.Host, "HTTP/1.1")
+	fmt.Fprintln(Outgoing, "Host", []string{req.Host})
+	for k, v := range req.Header {
+		fmt.Fprintln(Outgoing, k, v)
+	}
+	fmt.Fprintln(Outgoing)
+
+	fmt.Fprintf(Incoming, "%s %s\n", protoName(resp), resp.Status)
+	for k, v := range resp.Header {
+		fmt.Fprintln(Incoming, k, v)
+	}
+	fmt.Fprintln(Incoming)
+
+	if resp.StatusCode == http.StatusOK {
+		Status.Println(" CONNECT phase completed")
+	}
+	return nil
+}
+
+func getEnvAny(names ...string) string {
+	for _, n := range names {
+		if val := os.Getenv(n); val != "" {
+			return val
+		}
+	}
+	return ""
+}
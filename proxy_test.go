@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+// setProxyEnv sets the proxy environment variables of the test, clearing
+// the other ones.
+func setProxyEnv(t *testing.T, env map[string]string) {
+	for _, name := range []string{"http_proxy", "HTTP_PROXY", "https_proxy", "HTTPS_PROXY",
+		"all_proxy", "ALL_PROXY", "no_proxy", "NO_PROXY"} {
+		t.Setenv(name, env[name])
+	}
+}
+
+func TestParseProxy(t *testing.T) {
+	t.Log("Testing parseProxy()... (expecting HTTP by default and the SOCKS schemes)")
+
+	for raw, expected := range map[string]string{
+		"proxy:3128":           "http://proxy:3128",
+		"http://proxy":         "http://proxy",
+		"https://bob:pw@proxy": "https://bob:pw@proxy",
+		"socks5h://proxy:1080": "socks5h://proxy:1080",
+		"socks4a://proxy":      "socks4a://proxy",
+	} {
+		u, err := parseProxy(raw)
+		if err != nil {
+			t.Errorf("Expected %q to be valid, but got %s", raw, err)
+			continue
+		}
+		if u.String() != expected {
+			t.Errorf("Expected %s for %q, but got %s", expected, raw, u)
+		}
+	}
+	for _, raw := range []string{"ftp://proxy", "http://", "http://[::1"} {
+		if _, err := parseProxy(raw); err == nil {
+			t.Errorf("Expected an error for %q", raw)
+		}
+	}
+}
+
+func TestProxySettings(t *testing.T) {
+	t.Log("Testing proxySettings()... (expecting the command line to take precedence over the environment)")
+
+	setProxyEnv(t, map[string]string{
+		"http_proxy": "envhttp:3128",
+		"ALL_PROXY":  "envall:3128",
+		"no_proxy":   "internal.example, 10.0.0.0/8",
+	})
+
+	ps, err := (&Options{}).proxySettings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ps.http.Host != "envhttp:3128" || ps.https.Host != "envall:3128" {
+		t.Errorf("Expected http_proxy and ALL_PROXY, but got %s and %s", ps.http, ps.https)
+	}
+	for host, expected := range map[string]bool{
+		"internal.example": true, "www.internal.example": true, "10.1.2.3": true,
+		"example.com": false, "11.0.0.1": false, "localhost": false,
+	} {
+		if got := ps.bypass(host); got != expected {
+			t.Errorf("Expected bypass(%q) to be %t with no_proxy, but got %t", host, expected, got)
+		}
+	}
+
+	ps, err = (&Options{proxy: "cli:8080", noProxy: "example.com"}).proxySettings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ps.http.Host != "cli:8080" || ps.https.Host != "cli:8080" {
+		t.Errorf("Expected -x for both schemes, but got %s and %s", ps.http, ps.https)
+	}
+	if ps.bypass("internal.example") || !ps.bypass("example.com") {
+		t.Errorf("Expected --noproxy to replace no_proxy, but got %v", ps.noProxy)
+	}
+}
+
+func TestProxyLoopback(t *testing.T) {
+	t.Log("Testing proxyRouter.Proxy()... (expecting the loopback targets to go through an explicit -x)")
+
+	setProxyEnv(t, nil)
+
+	r, err := (&Options{proxy: "proxy:3128", proxyUser: "bob:pw"}).newProxyRouter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, target := range []string{"http://localhost:8080/", "http://127.0.0.1/", "http://[::1]/"} {
+		req, _ := http.NewRequest("GET", target, nil)
+		p, err := r.Proxy(req)
+		if err != nil || p == nil || p.String() != "http://bob:pw@proxy:3128" {
+			t.Errorf("Expected %s to go through the proxy, but got %v (%v)", target, p, err)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseRate parses the rate of --limit-rate, in bytes per second, with an
+// optional K, M or G suffix for the multiples of 1024.
+func parseRate(s string) (int64, error) {
+	mult := 1.0
+	num := s
+	switch strings.ToUpper(s[len(s)-1:]) {
+	case "K":
+		mult = 1 << 10
+	case "M":
+		mult = 1 << 20
+	case "G":
+		mult = 1 << 30
+	}
+	if mult > 1 {
+		num = s[:len(s)-1]
+	}
+	v, err := strconv.ParseFloat(num, 64)
+	if err != nil || v*mult < 1 {
+		return 0, fmt.Errorf("unable to parse the rate %q; expected a number of bytes per second, like 100K or 2M", s)
+	}
+	return int64(v * mult), nil
+}
+
+// rateLimiter is a token bucket, which lets through rate bytes per second.
+// It holds the tokens of a tenth of a second at most, so that the transfer
+// stays smooth, and the progress meter too.
+type rateLimiter struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate int64) *rateLimiter {
+	l := &rateLimiter{rate: float64(rate), burst: float64(rate) / 10, last: time.Now()}
+	if l.burst < 1 {
+		l.burst = 1
+	}
+	return l
+}
+
+func (l *rateLimiter) refill() {
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+}
+
+// take waits until up to n bytes may be transferred and returns how many.
+func (l *rateLimiter) take(n int) int {
+	if float64(n) > l.burst {
+		n = int(l.burst)
+	}
+	l.refill()
+	if missing := float64(n) - l.tokens; missing > 0 {
+		time.Sleep(time.Duration(missing / l.rate * float64(time.Second)))
+		l.refill()
+	}
+	l.tokens -= float64(n)
+	return n
+}
+
+// giveBack returns the tokens of the bytes taken but not transferred.
+func (l *rateLimiter) giveBack(n int) {
+	l.tokens += float64(n)
+}
+
+// rateLimitedReader reads from Reader no faster than limiter allows. The
+// bytes are only read once allowed, so that the readers below, like the
+// progress meter of an upload, see the limited rate.
+type rateLimitedReader struct {
+	io.Reader
+	limiter *rateLimiter
+}
+
+func (r *rateLimitedReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return r.Reader.Read(p)
+	}
+	allowed := r.limiter.take(len(p))
+	n, err := r.Reader.Read(p[:allowed])
+	r.limiter.giveBack(allowed - n)
+	return n, err
+}
+
+// rateLimited returns r limited to --limit-rate, if given.
+func (o *Options) rateLimited(r io.Reader) io.Reader {
+	if o.rateLimit == 0 {
+		return r
+	}
+	return &rateLimitedReader{r, newRateLimiter(o.rateLimit)}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestParseRate(t *testing.T) {
+	t.Log("Testing parseRate()... (expecting bytes per second)")
+
+	for s, expected := range map[string]int64{
+		"200":  200,
+		"100K": 100 << 10,
+		"1.5m": 3 << 19,
+		"2G":   2 << 30,
+	} {
+		if got, err := parseRate(s); err != nil || got != expected {
+			t.Errorf("Expected %d for %s, but got %d (%v)", expected, s, got, err)
+		}
+	}
+	for _, s := range []string{"fast", "K", "0", "-1M"} {
+		if _, err := parseRate(s); err == nil {
+			t.Errorf("Expected an error for %q", s)
+		}
+	}
+}
+
+func TestRateLimitedReader(t *testing.T) {
+	t.Log("Testing rateLimitedReader... (expecting 50K read in about half a second at 100K)")
+
+	opts := Options{rateLimit: 100 << 10}
+	r := opts.rateLimited(bytes.NewReader(make([]byte, 50<<10)))
+	start := time.Now()
+	n, err := io.Copy(ioutil.Discard, r)
+	elapsed := time.Since(start)
+	if err != nil || n != 50<<10 {
+		t.Fatalf("Expected 51200 bytes, but got %d (%v)", n, err)
+	}
+	if elapsed < 400*time.Millisecond || elapsed > time.Second {
+		t.Errorf("Expected the read to take about 500ms, but it took %s", elapsed)
+	}
+}
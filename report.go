@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// transferReport is the --json-report document of one URL.
+type transferReport struct {
+	URL          string           `json:"url"`
+	URLNum       int              `json:"url_num"`
+	Start        time.Time        `json:"start"`
+	EffectiveURL string           `json:"effective_url,omitempty"`
+	Request      *reportRequest   `json:"request,omitempty"`
+	Response     *reportResponse  `json:"response,omitempty"`
+	Redirects    []reportRedirect `json:"redirects,omitempty"`
+	Timings      reportTimings    `json:"timings"`
+	Connection   reportConnection `json:"connection"`
+	TLS          *reportTLS       `json:"tls,omitempty"`
+	Bytes        reportBytes      `json:"bytes"`
+	Error        *reportError     `json:"error,omitempty"`
+	ExitCode     int              `json:"exit_code"`
+}
+
+type reportRequest struct {
+	Method  string      `json:"method"`
+	URL     string      `json:"url"`
+	Target  string      `json:"target"`
+	Headers http.Header `json:"headers"`
+}
+
+type reportResponse struct {
+	Protocol string      `json:"protocol"`
+	Status   int         `json:"status"`
+	Reason   string      `json:"reason"`
+	Headers  http.Header `json:"headers"`
+}
+
+// reportRedirect is a request answered with a redirect which was followed.
+type reportRedirect struct {
+	Request  reportRequest   `json:"request"`
+	Response *reportResponse `json:"response,omitempty"`
+	Location string          `json:"location,omitempty"`
+}
+
+// reportTimings are the ends of the phases of the last request, in seconds
+// since the start of the transfer, like the time_* variables of --write-out.
+type reportTimings struct {
+	NameLookup    float64 `json:"namelookup"`
+	Connect       float64 `json:"connect"`
+	AppConnect    float64 `json:"appconnect"`
+	PreTransfer   float64 `json:"pretransfer"`
+	StartTransfer float64 `json:"starttransfer"`
+	Redirect      float64 `json:"redirect"`
+	Total         float64 `json:"total"`
+}
+
+type reportConnection struct {
+	RemoteAddr  string `json:"remote_addr,omitempty"`
+	LocalAddr   string `json:"local_addr,omitempty"`
+	Reused      bool   `json:"reused"`
+	NumConnects int    `json:"num_connects"`
+}
+
+type reportTLS struct {
+	Version      string              `json:"version"`
+	CipherSuite  string              `json:"cipher_suite"`
+	ALPN         string              `json:"alpn,omitempty"`
+	ServerName   string              `json:"server_name,omitempty"`
+	Resumed      bool                `json:"resumed"`
+	Certificates []reportCertificate `json:"certificates,omitempty"`
+}
+
+type reportCertificate struct {
+	Subject   string    `json:"subject"`
+	Issuer    string    `json:"issuer"`
+	DNSNames  []string  `json:"dns_names,omitempty"`
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+	Serial    string    `json:"serial"`
+	SHA256    string    `json:"sha256"`
+}
+
+type reportBytes struct {
+	Upload   int64 `json:"upload"`
+	Download int64 `json:"download"`
+	Header   int64 `json:"header"`
+	Request  int64 `json:"request"`
+}
+
+type reportError struct {
+	Message string `json:"message"`
+	Type    string `json:"type"`
+}
+
+// openJSONReport opens the --json-report destination, "-" being stderr. The
+// reports are appended to the file.
+func (o *Options) openJSONReport() (io.WriteCloser, error) {
+	if o.jsonReport == "-" {
+		return nopWriteCloser{os.Stderr}, nil
+	}
+	f, err := os.OpenFile(o.jsonReport, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open the JSON report file; %s", err)
+	}
+	return f, nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// writeJSONReport writes the report of the transfer on a single line.
+func writeJSONReport(w io.Writer, url string, s *transferStats) error {
+	data, err := json.Marshal(s.report(url))
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+// report builds the --json-report document of the transfer of url.
+func (s *transferStats) report(url string) *transferReport {
+	namelookup, connect, appconnect, pretransfer, starttransfer := s.phases()
+	redirect := s.redirectTime()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r := &transferReport{
+		URL:    url,
+		URLNum: s.urlNum,
+		Start:  s.start,
+		Timings: reportTimings{
+			NameLookup:    namelookup.Seconds(),
+			Connect:       connect.Seconds(),
+			AppConnect:    appconnect.Seconds(),
+			PreTransfer:   pretransfer.Seconds(),
+			StartTransfer: starttransfer.Seconds(),
+			Redirect:      redirect.Seconds(),
+			Total:         s.end.Sub(s.start).Seconds(),
+		},
+		Connection: reportConnection{NumConnects: s.numConns},
+		Bytes:      reportBytes{Upload: s.uploaded, Download: s.downloaded},
+		ExitCode:   exitCodeFor(s.err),
+	}
+	if s.err != nil {
+		r.Error = &reportError{Message: s.err.Error(), Type: classifyError(s.err)}
+	}
+
+	for i, h := range s.hops {
+		r.Bytes.Request += requestHeaderSize(h.req)
+		if h.resp != nil {
+			r.Bytes.Header += responseHeaderSize(h.resp)
+		}
+		if i < len(s.hops)-1 {
+			rd := reportRedirect{Request: *newReportRequest(h.req), Response: newReportResponse(h.resp)}
+			if h.resp != nil {
+				rd.Location = h.resp.Header.Get("Location")
+			}
+			r.Redirects = append(r.Redirects, rd)
+		}
+	}
+
+	h := s.hop()
+	if h == nil {
+		return r
+	}
+	r.EffectiveURL = h.req.URL.String()
+	r.Request = newReportRequest(h.req)
+	r.Response = newReportResponse(h.resp)
+	r.Connection.RemoteAddr = h.remoteAddr
+	r.Connection.LocalAddr = h.localAddr
+	r.Connection.Reused = h.reused
+	if h.resp != nil && h.resp.TLS != nil {
+		r.TLS = newReportTLS(h.resp.TLS)
+	}
+	return r
+}
+
+// redactedHeaders are the request headers carrying credentials, whose values
+// are left out of the reports.
+var redactedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie"}
+
+func newReportRequest(req *http.Request) *reportRequest {
+	return &reportRequest{
+		Method:  req.Method,
+		URL:     req.URL.String(),
+		Target:  req.URL.RequestURI(),
+		Headers: redactHeaders(req.Header),
+	}
+}
+
+// redactHeaders returns a copy of h with the values of the redactedHeaders
+// replaced.
+func redactHeaders(h http.Header) http.Header {
+	h = h.Clone()
+	for _, name := range redactedHeaders {
+		if len(h.Values(name)) > 0 {
+			h.Set(name, "<redacted>")
+		}
+	}
+	return h
+}
+
+func newReportResponse(resp *http.Response) *reportResponse {
+	if resp == nil {
+		return nil
+	}
+	return &reportResponse{
+		Protocol: protoName(resp),
+		Status:   resp.StatusCode,
+		Reason:   strings.TrimSpace(strings.TrimPrefix(resp.Status, fmt.Sprint(resp.StatusCode))),
+		Headers:  resp.Header,
+	}
+}
+
+func newReportTLS(cs *tls.ConnectionState) *reportTLS {
+	r := &reportTLS{
+		Version:     tlsVersionName(cs.Version),
+		CipherSuite: cipherSuiteName(cs.CipherSuite),
+		ALPN:        cs.NegotiatedProtocol,
+		ServerName:  cs.ServerName,
+		Resumed:     cs.DidResume,
+	}
+	for _, cert := range cs.PeerCertificates {
+		fp := sha256.Sum256(cert.Raw)
+		r.Certificates = append(r.Certificates, reportCertificate{
+			Subject:   cert.Subject.String(),
+			Issuer:    cert.Issuer.String(),
+			DNSNames:  cert.DNSNames,
+			NotBefore: cert.NotBefore,
+			NotAfter:  cert.NotAfter,
+			Serial:    cert.SerialNumber.Text(16),
+			SHA256:    hex.EncodeToString(fp[:]),
+		})
+	}
+	return r
+}
+
+// classifyError returns the kind of failure of a transfer: "dns",
+// "connect", "proxy", "timeout", "tls", "tls_verify", "pinned_pubkey",
+// "cert_status", "cert_expiry", "url", "http" or "other".
+func classifyError(err error) string {
+	var dnsErr *net.DNSError
+	var opErr *net.OpError
+	var verifyErr *tls.CertificateVerificationError
+	var unknownAuth x509.UnknownAuthorityError
+	var hostErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+
+	var exitErr *exitError
+	var timeoutErr *timeoutError
+	var socksErr *socksError
+
+	switch {
+	case errors.As(err, &exitErr) && exitErr.code == exitHTTPError:
+		return "http"
+	case errors.As(err, &timeoutErr):
+		return "timeout"
+	case errors.Is(err, errPinnedPubKey):
+		return "pinned_pubkey"
+	case errors.Is(err, errCertStatus):
+		return "cert_status"
+	case errors.Is(err, errCertExpiry):
+		return "cert_expiry"
+	case errors.As(err, &verifyErr), errors.As(err, &unknownAuth), errors.As(err, &hostErr), errors.As(err, &invalidErr):
+		return "tls_verify"
+	case errors.As(err, &dnsErr):
+		return "dns"
+	case errors.Is(err, context.DeadlineExceeded), isTimeout(err):
+		return "timeout"
+	case errors.As(err, &opErr) && opErr.Op == "proxyconnect", errors.As(err, &socksErr),
+		strings.Contains(err.Error(), "proxyconnect"):
+		return "proxy"
+	case errors.As(err, &opErr) && opErr.Op == "dial":
+		return "connect"
+	case isTLSHandshakeError(err):
+		return "tls"
+	case strings.Contains(err.Error(), "unsupported protocol scheme"), strings.Contains(err.Error(), "does not parse correctly as a URL"):
+		return "url"
+	case strings.Contains(err.Error(), "malformed HTTP"), strings.Contains(err.Error(), "http2:"):
+		return "http"
+	}
+	return "other"
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestJSONReport(t *testing.T) {
+	t.Log("Testing writeJSONReport()... (expecting the redirect chain and the TLS details)")
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/old" {
+			http.Redirect(w, r, "/new", http.StatusMovedPermanently)
+			return
+		}
+		w.Write([]byte("hello"))
+	}))
+	defer srv.Close()
+
+	stats := newTransferStats(3)
+	c := srv.Client()
+	c.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		statsFromContext(req.Context()).redirect(req)
+		return nil
+	}
+	req, _ := http.NewRequest("GET", srv.URL+"/old", nil)
+	resp, err := c.Do(stats.attach(req))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	stats.gotResponse(resp)
+	stats.finish(nil)
+
+	var buf bytes.Buffer
+	if err := writeJSONReport(&buf, srv.URL+"/old", stats); err != nil {
+		t.Fatal(err)
+	}
+	var r transferReport
+	if err := json.Unmarshal(buf.Bytes(), &r); err != nil {
+		t.Fatalf("Invalid report %q : %s", buf.String(), err)
+	}
+	if r.URLNum != 3 || r.EffectiveURL != srv.URL+"/new" || r.Response == nil || r.Response.Status != 200 {
+		t.Errorf("Unexpected report %s", buf.String())
+	}
+	if len(r.Redirects) != 1 || r.Redirects[0].Response.Status != 301 || r.Redirects[0].Location != "/new" {
+		t.Errorf("Expected one 301 redirect, but got %+v", r.Redirects)
+	}
+	if r.TLS == nil || r.TLS.Version == "" || len(r.TLS.Certificates) == 0 {
+		t.Errorf("Expected the TLS details, but got %+v", r.TLS)
+	}
+	if r.Error != nil || r.ExitCode != 0 {
+		t.Errorf("Expected no error, but got %+v", r.Error)
+	}
+}
+
+func TestReportTLSCipherSuite(t *testing.T) {
+	t.Log("Testing newReportTLS()... (expecting the cipher suite names of the verbose output)")
+
+	for id, expected := range map[uint16]string{
+		tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256: "ECDHE-RSA-AES128-GCM-SHA256",
+		tls.TLS_AES_128_GCM_SHA256:                "TLS_AES_128_GCM_SHA256",
+	} {
+		r := newReportTLS(&tls.ConnectionState{Version: tls.VersionTLS12, CipherSuite: id})
+		if r.CipherSuite != expected {
+			t.Errorf("Expected %s, but got %s", expected, r.CipherSuite)
+		}
+	}
+}
+
+func TestClassifyError(t *testing.T) {
+	t.Log("Testing classifyError()...")
+
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{&net.DNSError{Err: "no such host", Name: "example.invalid"}, "dns"},
+		{&net.OpError{Op: "dial", Err: errors.New("connection refused")}, "connect"},
+		{&net.OpError{Op: "proxyconnect", Err: errors.New("connection refused")}, "proxy"},
+		{&socksError{"SOCKS4", "1.2.3.4:80", errors.New("request rejected by the proxy (code 91)")}, "proxy"},
+		{&socksError{"SOCKS4", "1.2.3.4:80", &net.OpError{Op: "dial", Err: errors.New("connection refused")}}, "proxy"},
+		{fmt.Errorf("wrapped: %w", errPinnedPubKey), "pinned_pubkey"},
+		{fmt.Errorf("%w; no OCSP response stapled", errCertStatus), "cert_status"},
+		{&net.OpError{Op: "remote error", Err: errors.New("tls: handshake failure")}, "tls"},
+		{errors.New("something else"), "other"},
+	}
+	for _, tt := range tests {
+		if got := classifyError(tt.err); got != tt.want {
+			t.Errorf("Expected %s for %q, but got %s", tt.want, tt.err, got)
+		}
+	}
+}
+
+func TestReportRedaction(t *testing.T) {
+	t.Log("Testing newReportRequest()... (expecting the credentials to be redacted)")
+
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	req.Header.Set("Authorization", "Basic Ym9iOnNlY3JldA==")
+	req.Header.Set("Proxy-Authorization", "Basic c2VjcmV0")
+	req.Header.Add("Cookie", "session=secret")
+	req.Header.Add("Cookie", "other=secret")
+	req.Header.Set("Accept", "*/*")
+
+	r := newReportRequest(req)
+	for _, name := range []string{"Authorization", "Proxy-Authorization", "Cookie"} {
+		if v := r.Headers[name]; len(v) != 1 || v[0] != "<redacted>" {
+			t.Errorf("Expected %s to be redacted, but got %q", name, v)
+		}
+	}
+	if v := r.Headers.Get("Accept"); v != "*/*" {
+		t.Errorf("Expected Accept to be kept, but got %q", v)
+	}
+	if v := req.Header.Get("Authorization"); v != "Basic Ym9iOnNlY3JldA==" {
+		t.Errorf("Expected the request to be untouched, but got %q", v)
+	}
+}
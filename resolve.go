@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// hostOverrides holds the --resolve and --connect-to rules.
+type hostOverrides struct {
+	resolve   map[string][]string // "host:port" -> addresses
+	connectTo []connectTo
+}
+
+// connectTo is a --connect-to rule. Empty fields of the source match any host
+// or port, and empty fields of the destination keep the original value.
+type connectTo struct {
+	fromHost, fromPort string
+	toHost, toPort     string
+}
+
+// parseHostOverrides parses the --resolve "host:port:addr[,addr]..." and the
+// --connect-to "host1:port1:host2:port2" arguments. IPv6 addresses have to be
+// enclosed in brackets.
+func parseHostOverrides(resolve, connect []string) (*hostOverrides, error) {
+	ho := &hostOverrides{resolve: make(map[string][]string)}
+
+	for _, r := range resolve {
+		parts := splitHostList(r)
+		if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+			return nil, fmt.Errorf("invalid --resolve %q; expected host:port:addr[,addr]", r)
+		}
+		var addrs []string
+		for _, a := range strings.Split(parts[2], ",") {
+			a = strings.Trim(strings.TrimSpace(a), "[]")
+			if net.ParseIP(a) == nil {
+				return nil, fmt.Errorf("invalid address %q in --resolve %q", a, r)
+			}
+			addrs = append(addrs, a)
+		}
+		key := net.JoinHostPort(strings.ToLower(strings.Trim(parts[0], "[]")), parts[1])
+		ho.resolve[key] = append(ho.resolve[key], addrs...)
+	}
+
+	for _, c := range connect {
+		parts := splitHostList(c)
+		if len(parts) != 4 {
+			return nil, fmt.Errorf("invalid --connect-to %q; expected host1:port1:host2:port2", c)
+		}
+		ho.connectTo = append(ho.connectTo, connectTo{
+			fromHost: strings.ToLower(strings.Trim(parts[0], "[]")),
+			fromPort: parts[1],
+			toHost:   strings.Trim(parts[2], "[]"),
+			toPort:   parts[3],
+		})
+	}
+
+	return ho, nil
+}
+
+// redirect applies the first matching --connect-to rule to addr.
+func (ho *hostOverrides) redirect(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	for _, c := range ho.connectTo {
+		if c.fromHost != "" && c.fromHost != strings.ToLower(host) {
+			continue
+		}
+		if c.fromPort != "" && c.fromPort != port {
+			continue
+		}
+		if c.toHost != "" {
+			host = c.toHost
+		}
+		if c.toPort != "" {
+			port = c.toPort
+		}
+		return net.JoinHostPort(host, port)
+	}
+	return addr
+}
+
+// lookup returns the addresses given with --resolve for addr, if any. A "*"
+// host matches every host name on that port.
+func (ho *hostOverrides) lookup(addr string) []string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil
+	}
+	if addrs, ok := ho.resolve[net.JoinHostPort(strings.ToLower(host), port)]; ok {
+		return addrs
+	}
+	return ho.resolve[net.JoinHostPort("*", port)]
+}
+
+// splitHostList splits a colon separated list, keeping the colons of the
+// bracketed IPv6 addresses.
+func splitHostList(s string) []string {
+	var parts []string
+	depth, start := 0, 0
+	for i, r := range s {
+		switch r {
+		case '[':
+			depth++
+		case ']':
+			depth--
+		case ':':
+			if depth == 0 {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, s[start:])
+}
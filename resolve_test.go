@@ -0,0 +1,39 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestHostOverrides(t *testing.T) {
+	t.Log("Testing parseHostOverrides()... (expecting --resolve and --connect-to rules)")
+
+	ho, err := parseHostOverrides(
+		[]string{"example.com:443:127.0.0.1,[::1]", "*:80:10.0.0.1"},
+		[]string{"example.com:443:backend.internal:8443", "::[::1]:"},
+	)
+	if err != nil {
+		t.Fatalf("parseHostOverrides() failed : %s", err)
+	}
+
+	if got := ho.lookup("Example.com:443"); !reflect.DeepEqual(got, []string{"127.0.0.1", "::1"}) {
+		t.Errorf("Expected both addresses for example.com:443, but got %v", got)
+	}
+	if got := ho.lookup("other.org:80"); !reflect.DeepEqual(got, []string{"10.0.0.1"}) {
+		t.Errorf("Expected the wildcard address for other.org:80, but got %v", got)
+	}
+	if got := ho.lookup("other.org:443"); got != nil {
+		t.Errorf("Expected no address for other.org:443, but got %v", got)
+	}
+
+	if got := ho.redirect("example.com:443"); got != "backend.internal:8443" {
+		t.Errorf("Expected backend.internal:8443, but got %s", got)
+	}
+	if got := ho.redirect("other.org:8080"); got != "[::1]:8080" {
+		t.Errorf("Expected [::1]:8080, but got %s", got)
+	}
+
+	if _, err := parseHostOverrides([]string{"example.com:443"}, nil); err == nil {
+		t.Error("Expected an error for a malformed --resolve")
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+const (
+	// the first delay between the attempts, doubled after every retry
+	retryBackoff = time.Second
+	// the longest delay between the attempts
+	retryMaxBackoff = 10 * time.Minute
+)
+
+// retrier decides whether the failed attempts of a transfer are retried,
+// with --retry and the related options, and how long to wait before.
+type retrier struct {
+	left        uint          // the retries left
+	fixed       time.Duration // --retry-delay, instead of the backoff
+	maxTime     time.Duration // --retry-max-time
+	connRefused bool
+	allErrors   bool
+
+	start   time.Time
+	backoff time.Duration
+
+	// The -C, --continue-at of the next attempt, and whether it resumes the
+	// download of a failed one.
+	continueAt string
+	resumed    bool
+	// Some of the output was written to a destination which can't be rewound.
+	written bool
+}
+
+// newRetrier returns the retrier of a transfer, or nil if --retry isn't
+// given.
+func (o *Options) newRetrier() *retrier {
+	if o.retry == 0 {
+		return nil
+	}
+	return &retrier{
+		left:        o.retry,
+		fixed:       time.Duration(o.retryDelay) * time.Second,
+		maxTime:     time.Duration(o.retryMaxTime) * time.Second,
+		connRefused: o.retryRefused,
+		allErrors:   o.retryAllErrors,
+		start:       time.Now(),
+		backoff:     retryBackoff,
+		continueAt:  o.continueAt,
+	}
+}
+
+// retryStatusError is returned by fetchUrl for a response with a transient
+// status which is retried, its body being ignored.
+type retryStatusError struct {
+	status int
+	wait   time.Duration
+}
+
+func (e *retryStatusError) Error() string {
+	return fmt.Sprintf("HTTP error %d", e.status)
+}
+
+// fetchWithRetries transfers target, retrying the failed attempts as
+// requested. Every attempt builds its request again, so the bodies of -T, -d
+// and -F are read from the start.
+func fetchWithRetries(target globbedURL, opts Options, stats *transferStats) error {
+	retry := opts.newRetrier()
+	for {
+		err := fetchUrl(target, opts, stats, retry)
+		if err == nil || retry == nil {
+			return err
+		}
+
+		var statusErr *retryStatusError
+		var wait time.Duration
+		var ok bool
+		if errors.As(err, &statusErr) {
+			wait, ok = statusErr.wait, true
+		} else {
+			wait, ok = retry.delay(nil, err)
+		}
+		if !ok {
+			return err
+		}
+
+		retry.left--
+		stats.retried()
+		if !opts.silent {
+			Status.Printf(" Transient problem: %s; will retry in %s, %d retries left\n", err, wait, retry.left)
+		}
+		time.Sleep(wait)
+		if retry.fixed == 0 {
+			retry.backoff *= 2
+			if retry.backoff > retryMaxBackoff {
+				retry.backoff = retryMaxBackoff
+			}
+		}
+		opts.continueAt = retry.continueAt
+	}
+}
+
+// delay returns how long to wait before retrying the failed attempt, resp
+// being its response or err its error, and whether it is retried at all.
+func (r *retrier) delay(resp *http.Response, err error) (time.Duration, bool) {
+	if r == nil || r.left == 0 || r.written {
+		return 0, false
+	}
+	if resp != nil && !transientStatus(resp.StatusCode) || resp == nil && !r.transientError(err) {
+		return 0, false
+	}
+
+	wait := r.backoff
+	if r.fixed > 0 {
+		wait = r.fixed
+	}
+	if resp != nil {
+		if after, ok := retryAfter(resp, time.Now()); ok {
+			wait = after
+		}
+	}
+	if r.maxTime > 0 && time.Since(r.start)+wait > r.maxTime {
+		return 0, false
+	}
+	return wait, true
+}
+
+// retryResponse returns the error retrying the attempt which got resp, or nil
+// if it isn't retried and its body is the output.
+func (r *retrier) retryResponse(resp *http.Response) error {
+	if wait, ok := r.delay(resp, nil); ok {
+		return &retryStatusError{status: resp.StatusCode, wait: wait}
+	}
+	return nil
+}
+
+// failedDownload records how far the download went when its body couldn't
+// be received, written telling whether some of the output was written. The
+// next attempt resumes the download at the end of the output file, or starts
+// it over when the output isn't the body as received, being decoded or
+// including the headers. Once some of the output was written to stdout, the
+// transfer can't be retried.
+func (r *retrier) failedDownload(out *os.File, toFile, fromStart, written bool) {
+	if r == nil || !written {
+		return
+	}
+	switch {
+	case !toFile:
+		r.written = true
+	case fromStart:
+		if _, err := out.Seek(0, io.SeekStart); err != nil || out.Truncate(0) != nil {
+			r.written = true
+		}
+		r.continueAt, r.resumed = "", false
+	default:
+		pos, err := out.Seek(0, io.SeekCurrent)
+		if err != nil {
+			r.written = true
+			return
+		}
+		r.continueAt, r.resumed = strconv.FormatInt(pos, 10), true
+	}
+}
+
+// startOver empties the output file when the server answers the resumed
+// download with the whole body, ignoring the range.
+func (r *retrier) startOver(out *os.File, resp *http.Response) error {
+	if r == nil || !r.resumed || resp.StatusCode != http.StatusOK {
+		return nil
+	}
+	r.continueAt, r.resumed = "", false
+	if _, err := out.Seek(0, io.SeekStart); err != nil {
+		return withExitCode(exitWriteError, fmt.Errorf("unable to seek in the output file; %w", err))
+	}
+	if err := out.Truncate(0); err != nil {
+		return withExitCode(exitWriteError, fmt.Errorf("unable to truncate the output file; %w", err))
+	}
+	return nil
+}
+
+// transientStatus reports whether an HTTP status is a transient failure,
+// the same ones as cURL.
+func transientStatus(status int) bool {
+	switch status {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests, http.StatusInternalServerError,
+		http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout, 522, 524:
+		return true
+	}
+	return false
+}
+
+// transientError reports whether the error of an attempt is retried: the
+// timeouts and the connections reset or closed by the server, the refused
+// connections with --retry-connrefused, and any error with
+// --retry-all-errors.
+func (r *retrier) transientError(err error) bool {
+	switch {
+	case r.allErrors:
+		return true
+	case exitCodeFor(err) == exitTimeout:
+		return true
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, io.EOF):
+		return true
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return r.connRefused
+	}
+	return false
+}
+
+// retryAfter returns the delay requested by the Retry-After header of resp,
+// given either in seconds or as a date.
+func retryAfter(resp *http.Response, now time.Time) (time.Duration, bool) {
+	v := resp.Header.Get("Retry-After")
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.ParseUint(v, 10, 32); err == nil {
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if t.Before(now) {
+			return 0, true
+		}
+		return t.Sub(now), true
+	}
+	return 0, false
+}
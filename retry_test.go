@@ -0,0 +1,91 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRetryAfter(t *testing.T) {
+	t.Log("Testing retryAfter()... (expecting seconds and dates)")
+
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for v, expected := range map[string]time.Duration{
+		"120":                           2 * time.Minute,
+		"Wed, 01 Jan 2020 00:00:30 GMT": 30 * time.Second,
+		"Tue, 31 Dec 2019 23:00:00 GMT": 0,
+	} {
+		resp := &http.Response{Header: http.Header{"Retry-After": {v}}}
+		if got, ok := retryAfter(resp, now); !ok || got != expected {
+			t.Errorf("Expected %s for %q, but got %s", expected, v, got)
+		}
+	}
+	if _, ok := retryAfter(&http.Response{Header: http.Header{"Retry-After": {"soon"}}}, now); ok {
+		t.Error("Expected an invalid Retry-After to be ignored")
+	}
+}
+
+func TestRetrierDelay(t *testing.T) {
+	t.Log("Testing retrier.delay()... (expecting only the transient failures to be retried)")
+
+	r := (&Options{retry: 2}).newRetrier()
+	for status, expected := range map[int]bool{200: false, 404: false, 408: true, 429: true, 501: false, 503: true} {
+		if _, ok := r.delay(&http.Response{StatusCode: status}, nil); ok != expected {
+			t.Errorf("Expected %t for the status %d, but got %t", expected, status, ok)
+		}
+	}
+	if wait, _ := r.delay(&http.Response{StatusCode: 503}, nil); wait != retryBackoff {
+		t.Errorf("Expected to wait %s, but got %s", retryBackoff, wait)
+	}
+
+	r = (&Options{retry: 2, retryMaxTime: 1}).newRetrier()
+	resp := &http.Response{StatusCode: 503, Header: http.Header{"Retry-After": {"5"}}}
+	if _, ok := r.delay(resp, nil); ok {
+		t.Error("Expected no retry past --retry-max-time")
+	}
+}
+
+func TestFetchWithRetries(t *testing.T) {
+	t.Log("Testing fetchWithRetries()... (expecting the download to be retried and resumed)")
+
+	attempts := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		switch attempts {
+		case 1:
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case 2:
+			// Half of the body, then the connection is lost.
+			w.Header().Set("Content-Length", "10")
+			w.Write([]byte("hello"))
+			w.(http.Flusher).Flush()
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+		default:
+			if rng := r.Header.Get("Range"); rng != "bytes=5-" {
+				t.Errorf("Expected the download to resume at 5, but got %q", rng)
+			}
+			w.Header().Set("Content-Range", "bytes 5-9/10")
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write([]byte("world"))
+		}
+	}))
+	defer srv.Close()
+
+	out := filepath.Join(t.TempDir(), "out")
+	opts := Options{method: "GET", silent: true, outputFilename: out, retry: 3}
+	stats := newTransferStats(0)
+	if err := fetchWithRetries(globbedURL{url: srv.URL}, opts, stats); err != nil {
+		t.Fatalf("Expected the transfer to succeed, but got %s", err)
+	}
+	if body, _ := ioutil.ReadFile(out); string(body) != "helloworld" {
+		t.Errorf("Expected helloworld, but got %q", body)
+	}
+	if attempts != 3 || stats.retries != 2 {
+		t.Errorf("Expected 3 attempts and 2 retries, but got %d and %d", attempts, stats.retries)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// isSocksScheme reports whether the proxy scheme is one of the SOCKS
+// variants. The "h" and "a" suffixed variants let the proxy resolve the
+// target host name instead of resolving it locally.
+func isSocksScheme(scheme string) bool {
+	switch scheme {
+	case "socks4", "socks4a", "socks5", "socks5h":
+		return true
+	}
+	return false
+}
+
+// socksError is the failure of a connection through a SOCKS proxy, the
+// connection to the proxy itself or the request made to it.
+type socksError struct {
+	version string // SOCKS4 or SOCKS5
+	target  string
+	err     error
+}
+
+func (e *socksError) Error() string {
+	return fmt.Sprintf("%s connection to %s failed; %s", e.version, e.target, e.err)
+}
+
+func (e *socksError) Unwrap() error { return e.err }
+
+// dialSocks connects to addr through the SOCKS proxy p. The connection to the
+// proxy itself is made with forward, so it shows up in the verbose trace like
+// any other connection.
+func dialSocks(ctx context.Context, forward *net.Dialer, p *url.URL, network, addr string, verbose bool) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	remoteDNS := p.Scheme == "socks4a" || p.Scheme == "socks5h"
+	if !remoteDNS && net.ParseIP(host) == nil {
+		ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		host = ips[0].String()
+		if p.Scheme == "socks4" {
+			// SOCKS4 can only carry IPv4 addresses
+			host = ""
+			for _, ip := range ips {
+				if ip4 := ip.IP.To4(); ip4 != nil {
+					host = ip4.String()
+					break
+				}
+			}
+			if host == "" {
+				return nil, &socksError{"SOCKS4", addr, errors.New("no IPv4 address")}
+			}
+		}
+	}
+
+	target := net.JoinHostPort(host, port)
+	if verbose {
+		resolved := "locally"
+		if remoteDNS {
+			resolved = "remotely"
+		}
+		Status.Printf(" %s connect to %s (%s resolved)\n", socksVersion(p.Scheme), target, resolved)
+	}
+
+	var conn net.Conn
+	switch p.Scheme {
+	case "socks5", "socks5h":
+		var auth *proxy.Auth
+		if p.User != nil {
+			pass, _ := p.User.Password()
+			auth = &proxy.Auth{User: p.User.Username(), Password: pass}
+		}
+		d, err := proxy.SOCKS5("tcp", socksProxyAddr(p), auth, forward)
+		if err != nil {
+			return nil, &socksError{"SOCKS5", target, err}
+		}
+		conn, err = d.(proxy.ContextDialer).DialContext(ctx, network, target)
+		if err != nil {
+			return nil, &socksError{"SOCKS5", target, err}
+		}
+	default:
+		conn, err = dialSocks4(ctx, forward, p, target)
+		if err != nil {
+			return nil, &socksError{"SOCKS4", target, err}
+		}
+	}
+
+	if verbose {
+		Status.Printf(" %s request granted.\n", socksVersion(p.Scheme))
+	}
+	return conn, nil
+}
+
+// dialSocks4 performs a SOCKS4 or SOCKS4a CONNECT request. The user name of
+// the proxy URL, if any, is sent as the user ID.
+func dialSocks4(ctx context.Context, forward *net.Dialer, p *url.URL, target string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", portStr)
+	}
+
+	req := []byte{4, 1, 0, 0}
+	binary.BigEndian.PutUint16(req[2:], uint16(port))
+
+	ip := net.ParseIP(host).To4()
+	if ip == nil {
+		if p.Scheme != "socks4a" {
+			return nil, fmt.Errorf("SOCKS4 can only connect to IPv4 addresses")
+		}
+		// SOCKS4a : an invalid address of 0.0.0.x asks the proxy to resolve
+		// the host name sent after the user ID.
+		ip = net.IPv4(0, 0, 0, 1).To4()
+	}
+	req = append(req, ip...)
+	if p.User != nil {
+		req = append(req, p.User.Username()...)
+	}
+	req = append(req, 0)
+	if net.ParseIP(host).To4() == nil {
+		req = append(req, host...)
+		req = append(req, 0)
+	}
+
+	conn, err := forward.DialContext(ctx, "tcp", socksProxyAddr(p))
+	if err != nil {
+		return nil, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	if _, err = conn.Write(req); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	var resp [8]byte
+	if _, err = io.ReadFull(conn, resp[:]); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp[0] != 0 {
+		conn.Close()
+		return nil, errors.New("malformed reply from the proxy")
+	}
+	if resp[1] != 90 {
+		conn.Close()
+		return nil, fmt.Errorf("request rejected by the proxy (code %d)", resp[1])
+	}
+	return conn, nil
+}
+
+// socksProxyAddr returns the address of the SOCKS proxy, using cURL's default
+// port when none is given.
+func socksProxyAddr(p *url.URL) string {
+	if p.Port() != "" {
+		return p.Host
+	}
+	return net.JoinHostPort(p.Hostname(), "1080")
+}
+
+func socksVersion(scheme string) string {
+	if scheme == "socks5" || scheme == "socks5h" {
+		return "SOCKS5"
+	}
+	return "SOCKS4"
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestDialSocks4a(t *testing.T) {
+	t.Log("Testing dialSocks() with a SOCKS4a proxy... (expecting the host name to be sent)")
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		r := bufio.NewReader(conn)
+		head := make([]byte, 8)
+		io.ReadFull(r, head)
+		user, _ := r.ReadBytes(0)
+		host, _ := r.ReadBytes(0)
+		received <- append(append(head, user...), host...)
+		conn.Write([]byte{0, 90, 0, 0, 0, 0, 0, 0})
+	}()
+
+	p, _ := url.Parse("socks4a://bob@" + l.Addr().String())
+	conn, err := dialSocks(context.Background(), &net.Dialer{}, p, "tcp", "example.com:8080", false)
+	if err != nil {
+		t.Fatalf("dialSocks() failed : %s", err)
+	}
+	conn.Close()
+
+	expected := []byte("\x04\x01\x1f\x90\x00\x00\x00\x01bob\x00example.com\x00")
+	if got := <-received; !bytes.Equal(got, expected) {
+		t.Errorf("Expected request %q, but got %q", expected, got)
+	}
+}
+
+func TestSocksErrors(t *testing.T) {
+	t.Log("Testing dialSocks() failures... (expecting proxy errors with cURL's exit code)")
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		io.ReadFull(r, make([]byte, 8))
+		r.ReadBytes(0)
+		conn.Write([]byte{0, 91, 0, 0, 0, 0, 0, 0})
+	}()
+	rejecting := l.Addr().String()
+	defer l.Close()
+
+	// A port which nothing listens on.
+	closed, _ := net.Listen("tcp", "127.0.0.1:0")
+	refused := closed.Addr().String()
+	closed.Close()
+
+	for _, proxy := range []string{"socks4://" + rejecting, "socks4://" + refused, "socks5://" + refused} {
+		p, _ := url.Parse(proxy)
+		_, err := dialSocks(context.Background(), &net.Dialer{}, p, "tcp", "1.2.3.4:80", false)
+		if classifyError(err) != "proxy" || exitCodeFor(err) != exitProxy {
+			t.Errorf("Expected a proxy error through %s, but got %v (%s, exit code %d)", proxy, err, classifyError(err), exitCodeFor(err))
+		}
+	}
+}
+
+// socks4Relay accepts SOCKS4a connections and relays them to the target,
+// counting them.
+func socks4Relay(t *testing.T) (net.Listener, *int32) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var count int32
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&count, 1)
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				head := make([]byte, 8)
+				if _, err := io.ReadFull(r, head); err != nil {
+					return
+				}
+				r.ReadBytes(0)
+				host, _ := r.ReadBytes(0)
+				port := strconv.Itoa(int(binary.BigEndian.Uint16(head[2:])))
+				target, err := net.Dial("tcp", net.JoinHostPort(string(bytes.TrimSuffix(host, []byte{0})), port))
+				if err != nil {
+					conn.Write([]byte{0, 91, 0, 0, 0, 0, 0, 0})
+					return
+				}
+				defer target.Close()
+				conn.Write([]byte{0, 90, 0, 0, 0, 0, 0, 0})
+				go io.Copy(target, r)
+				io.Copy(conn, target)
+			}()
+		}
+	}()
+	return l, &count
+}
+
+func TestSocksTransport(t *testing.T) {
+	t.Log("Testing socksTransport... (expecting concurrent requests through the proxy, and --noproxy to bypass it)")
+
+	setProxyEnv(t, nil)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+	l, count := socks4Relay(t)
+	defer l.Close()
+	target := strings.Replace(srv.URL, "127.0.0.1", "localhost", 1)
+
+	for noProxy, expected := range map[string]int32{"": 8, "localhost": 0} {
+		atomic.StoreInt32(count, 0)
+		tr, err := (&Options{proxy: "socks4a://" + l.Addr().String(), noProxy: noProxy}).newTransport()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Don't reuse the connections, so that every request dials.
+		tr.(*socksTransport).RoundTripper.(*http.Transport).DisableKeepAlives = true
+
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				resp, err := (&http.Client{Transport: tr}).Get(target)
+				if err != nil {
+					t.Errorf("Expected the request to succeed, but got %s", err)
+					return
+				}
+				resp.Body.Close()
+			}()
+		}
+		wg.Wait()
+		if got := atomic.LoadInt32(count); got != expected {
+			t.Errorf("Expected %d connections through the proxy with --noproxy %q, but got %d", expected, noProxy, got)
+		}
+	}
+}
+
+func TestSocksPrecedence(t *testing.T) {
+	t.Log("Testing proxyRouter.route()... (expecting -x and --socks5-hostname to take precedence over the environment)")
+
+	setProxyEnv(t, map[string]string{"ALL_PROXY": "socks5://envsocks", "no_proxy": "internal.example"})
+	u, _ := url.Parse("https://example.com/")
+	internal, _ := url.Parse("http://internal.example/")
+
+	for _, c := range []struct {
+		opts     Options
+		expected string
+	}{
+		{Options{}, "socks5://envsocks"},
+		{Options{proxy: "http://cli:3128"}, "http://cli:3128"},
+		{Options{proxy: "http://cli:3128", socks5Hostname: "clisocks:1080"}, "socks5h://clisocks:1080"},
+	} {
+		r, err := c.opts.newProxyRouter()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p := r.route(u); p == nil || p.String() != c.expected {
+			t.Errorf("Expected %s, but got %v", c.expected, p)
+		}
+		if p := r.route(internal); p != nil {
+			t.Errorf("Expected no_proxy to bypass %s, but got %s", internal, p)
+		}
+	}
+}
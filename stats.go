@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// transferStats collects what happened during the transfer of one URL, for
+// --write-out, --json-report and --har. Every request sent, redirects
+// included, is a hop.
+type transferStats struct {
+	mu         sync.Mutex
+	urlNum     int
+	start, end time.Time
+	hops       []*hopStats
+	firstHop   int // the first hop of the last attempt, after the retries
+	numConns   int
+	retries    int
+	uploaded   int64 // request body bytes sent
+	downloaded int64 // response body bytes received, before decoding
+	outputFile string
+	err        error
+	bar        *progressBar // the line of the transfer with --parallel
+
+	// The start of the request and response bodies, captured for --har.
+	reqBody, respBody *cappedBuffer
+}
+
+// hopStats holds the timings and the connection details of one request.
+// The zero times are the phases which didn't happen, like the DNS lookup and
+// the connection of a reused connection.
+type hopStats struct {
+	req        *http.Request
+	resp       *http.Response
+	start      time.Time
+	dnsStart   time.Time
+	dnsDone    time.Time
+	connStart  time.Time
+	connDone   time.Time
+	tlsStart   time.Time
+	tlsDone    time.Time
+	gotConn    time.Time
+	wroteReq   time.Time
+	firstByte  time.Time
+	end        time.Time
+	reused     bool
+	remoteAddr string
+	localAddr  string
+
+	// The header blocks of the responses, as received, for --include and
+	// --dump-header. Only HTTP/1.x connections capture them.
+	rawHeaders [][]byte
+	// The TLS state of a connection which the transport doesn't report.
+	tlsState *tls.ConnectionState
+}
+
+type statsKey struct{}
+
+// newTransferStats starts the statistics of the transfer of the urlNum-th
+// URL of the command line.
+func newTransferStats(urlNum int) *transferStats {
+	return &transferStats{urlNum: urlNum, start: time.Now()}
+}
+
+// attach returns a copy of req recording its progress into s, as the first
+// hop of an attempt at the transfer.
+func (s *transferStats) attach(req *http.Request) *http.Request {
+	s.mu.Lock()
+	s.firstHop = len(s.hops)
+	s.hops = append(s.hops, &hopStats{req: req, start: time.Now()})
+	s.mu.Unlock()
+
+	ctx := context.WithValue(req.Context(), statsKey{}, s)
+	return req.WithContext(httptrace.WithClientTrace(ctx, s.clientTrace()))
+}
+
+func statsFromContext(ctx context.Context) *transferStats {
+	s, _ := ctx.Value(statsKey{}).(*transferStats)
+	return s
+}
+
+// redirect records that the response of the current hop is followed by a
+// new request, req.
+func (s *transferStats) redirect(req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if h := s.hop(); h != nil {
+		h.resp = req.Response
+		h.end = now
+		h.fillTLS()
+	}
+	s.hops = append(s.hops, &hopStats{req: req, start: now})
+}
+
+// gotResponse records the final response of the transfer.
+func (s *transferStats) gotResponse(resp *http.Response) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if h := s.hop(); h != nil {
+		h.req = resp.Request
+		h.resp = resp
+		h.fillTLS()
+	}
+}
+
+// fillTLS sets the TLS state of the response of h when the transport didn't.
+func (h *hopStats) fillTLS() {
+	if h.resp != nil && h.resp.TLS == nil {
+		h.resp.TLS = h.tlsState
+	}
+}
+
+// transferred returns the bytes of the bodies sent and received so far.
+func (s *transferStats) transferred() int64 {
+	return atomic.LoadInt64(&s.uploaded) + atomic.LoadInt64(&s.downloaded)
+}
+
+// retried records that the attempt failed and the transfer is retried.
+func (s *transferStats) retried() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if h := s.hop(); h != nil && h.end.IsZero() {
+		h.end = time.Now()
+	}
+	s.retries++
+}
+
+// gotRawHeader records a header block received for the current hop.
+func (s *transferStats) gotRawHeader(block []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if h := s.hop(); h != nil {
+		h.rawHeaders = append(h.rawHeaders, block)
+	}
+}
+
+// finish marks the end of the transfer, err being its outcome.
+func (s *transferStats) finish(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.end = time.Now()
+	s.err = err
+	if h := s.hop(); h != nil && h.end.IsZero() {
+		h.end = s.end
+	}
+}
+
+// hop returns the current hop. The caller holds s.mu.
+func (s *transferStats) hop() *hopStats {
+	if len(s.hops) == 0 {
+		return nil
+	}
+	return s.hops[len(s.hops)-1]
+}
+
+// last returns the last hop of the transfer, or nil if no request was made.
+func (s *transferStats) last() *hopStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.hop()
+}
+
+func (s *transferStats) clientTrace() *httptrace.ClientTrace {
+	update := func(f func(h *hopStats, now time.Time)) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if h := s.hop(); h != nil {
+			f(h, time.Now())
+		}
+	}
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			update(func(h *hopStats, now time.Time) { h.dnsStart = now })
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			update(func(h *hopStats, now time.Time) { h.dnsDone = now })
+		},
+		ConnectStart: func(network, addr string) {
+			update(func(h *hopStats, now time.Time) {
+				if h.connStart.IsZero() {
+					h.connStart = now
+				}
+			})
+		},
+		ConnectDone: func(network, addr string, err error) {
+			if err != nil {
+				return
+			}
+			update(func(h *hopStats, now time.Time) {
+				h.connDone = now
+				h.remoteAddr = addr
+				s.numConns++
+			})
+		},
+		TLSHandshakeStart: func() {
+			update(func(h *hopStats, now time.Time) { h.tlsStart = now })
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			update(func(h *hopStats, now time.Time) { h.tlsDone = now })
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			tlsState := connTLSState(info.Conn)
+			update(func(h *hopStats, now time.Time) {
+				h.gotConn = now
+				h.reused = info.Reused
+				h.tlsState = tlsState
+				if info.Conn != nil {
+					h.remoteAddr = info.Conn.RemoteAddr().String()
+					h.localAddr = info.Conn.LocalAddr().String()
+				}
+			})
+			// Outside of s.mu, the connection calls gotRawHeader with its
+			// own lock held.
+			if c, ok := info.Conn.(*wireConn); ok {
+				c.setOnHeader(s.gotRawHeader)
+			}
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			update(func(h *hopStats, now time.Time) { h.wroteReq = now })
+		},
+		GotFirstResponseByte: func() {
+			update(func(h *hopStats, now time.Time) { h.firstByte = now })
+		},
+	}
+}
+
+// phases returns the times, since the start of the transfer, at which the
+// phases of the last hop ended, in the order of --write-out: name lookup,
+// connect, TLS handshake, pre-transfer and start of the transfer. A phase
+// which didn't happen takes the time of the previous one, the TLS handshake
+// being zero for cleartext requests.
+func (s *transferStats) phases() (namelookup, connect, appconnect, pretransfer, starttransfer time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h := s.hop()
+	if h == nil {
+		return
+	}
+
+	prev := h.start
+	at := func(t time.Time) time.Duration {
+		if !t.IsZero() && t.After(prev) {
+			prev = t
+		}
+		return prev.Sub(s.start)
+	}
+	namelookup = at(h.dnsDone)
+	connect = at(h.connDone)
+	if h.req.URL.Scheme == "https" {
+		appconnect = at(h.tlsDone)
+	}
+	pretransfer = at(h.gotConn)
+	starttransfer = at(h.firstByte)
+	return
+}
+
+// redirectTime returns the time spent in the hops of the last attempt before
+// the last one.
+func (s *transferStats) redirectTime() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.hops) < s.firstHop+2 {
+		return 0
+	}
+	return s.hop().start.Sub(s.hops[s.firstHop].start)
+}
+
+// captureBodies makes the transfer keep the first limit bytes of the request
+// and response bodies.
+func (s *transferStats) captureBodies(limit int) {
+	s.reqBody = &cappedBuffer{limit: limit}
+	s.respBody = &cappedBuffer{limit: limit}
+}
+
+// cappedBuffer keeps the first limit bytes written to it, and counts the
+// others.
+type cappedBuffer struct {
+	buf   bytes.Buffer
+	limit int
+	total int64
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	b.total += int64(len(p))
+	if room := b.limit - b.buf.Len(); room > 0 {
+		if len(p) > room {
+			b.buf.Write(p[:room])
+		} else {
+			b.buf.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+func (b *cappedBuffer) Bytes() []byte  { return b.buf.Bytes() }
+func (b *cappedBuffer) String() string { return b.buf.String() }
+func (b *cappedBuffer) Len() int       { return b.buf.Len() }
+
+// countingReader counts the bytes read through it into n, atomically, as
+// --speed-limit watches it.
+type countingReader struct {
+	io.Reader
+	n *int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	atomic.AddInt64(r.n, int64(n))
+	return n, err
+}
+
+// countingReadCloser is a countingReader for request bodies.
+type countingReadCloser struct {
+	countingReader
+	io.Closer
+}
+
+func splitAddr(addr string) (string, string) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr, ""
+	}
+	return host, port
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// timeoutError is the failure of a transfer which took too long, or was too
+// slow. It is a net.Error, kurly exits with the code 28 for it.
+type timeoutError struct {
+	msg string
+	err error
+}
+
+func (e *timeoutError) Error() string   { return e.msg }
+func (e *timeoutError) Unwrap() error   { return e.err }
+func (e *timeoutError) Timeout() bool   { return true }
+func (e *timeoutError) Temporary() bool { return true }
+
+// transferTimer cancels the context of an attempt at a transfer once
+// --max-time expires, or when it is slower than --speed-limit for
+// --speed-time.
+type transferTimer struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	start  time.Time
+
+	maxTime    time.Duration
+	speedLimit int64 // bytes per second
+	speedTime  time.Duration
+	tick       time.Duration // how often the speed is measured
+
+	progress func() int64 // the bytes transferred so far
+	slow     int32        // set, atomically, when the transfer was too slow
+	done     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// newTransferTimer starts the timer of an attempt at a transfer, progress
+// returning the bytes transferred so far. Its context, ctx, is the one of the
+// requests.
+func (o *Options) newTransferTimer(progress func() int64) *transferTimer {
+	t := &transferTimer{
+		start:      time.Now(),
+		maxTime:    time.Duration(o.maxTime) * time.Second,
+		speedLimit: int64(o.speedLimit),
+		speedTime:  time.Duration(o.speedTime) * time.Second,
+		tick:       time.Second,
+		progress:   progress,
+		done:       make(chan struct{}),
+	}
+	// As with cURL, either speed option alone enables the check, the other
+	// one defaulting to 1 byte per second or 30 seconds.
+	if t.speedLimit > 0 && t.speedTime == 0 {
+		t.speedTime = 30 * time.Second
+	}
+	if t.speedTime > 0 && t.speedLimit == 0 {
+		t.speedLimit = 1
+	}
+
+	if t.maxTime > 0 {
+		t.ctx, t.cancel = context.WithTimeout(context.Background(), t.maxTime)
+	} else {
+		t.ctx, t.cancel = context.WithCancel(context.Background())
+	}
+	if t.speedTime > 0 {
+		t.wg.Add(1)
+		go t.watchSpeed()
+	}
+	return t
+}
+
+// watchSpeed cancels the transfer when less than speedLimit bytes per second
+// were transferred during speedTime.
+func (t *transferTimer) watchSpeed() {
+	defer t.wg.Done()
+	ticker := time.NewTicker(t.tick)
+	defer ticker.Stop()
+
+	last, slowSince := t.progress(), time.Now()
+	for {
+		select {
+		case <-t.done:
+			return
+		case now := <-ticker.C:
+			n := t.progress()
+			if float64(n-last) >= float64(t.speedLimit)*t.tick.Seconds() {
+				slowSince = now
+			} else if now.Sub(slowSince) >= t.speedTime {
+				atomic.StoreInt32(&t.slow, 1)
+				t.cancel()
+				return
+			}
+			last = n
+		}
+	}
+}
+
+// stop releases the timer once the attempt is over.
+func (t *transferTimer) stop() {
+	close(t.done)
+	t.wg.Wait()
+	t.cancel()
+}
+
+// check returns the timeoutError of the attempt if it was cancelled by the
+// timer, err being the error it failed with. Any other error is returned as
+// is.
+func (t *transferTimer) check(err error) error {
+	if err == nil || t.ctx.Err() == nil {
+		return err
+	}
+	if atomic.LoadInt32(&t.slow) != 0 {
+		return &timeoutError{
+			msg: fmt.Sprintf("Operation too slow. Less than %d bytes/sec transferred the last %d seconds", t.speedLimit, int(t.speedTime.Seconds())),
+			err: err,
+		}
+	}
+	return &timeoutError{
+		msg: fmt.Sprintf("Operation timed out after %d milliseconds", time.Since(t.start).Milliseconds()),
+		err: err,
+	}
+}
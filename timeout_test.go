@@ -0,0 +1,51 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTransferTimeouts(t *testing.T) {
+	t.Log("Testing newTransferTimer()... (expecting --max-time and --speed-limit to fail with exit code 28)")
+
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/stall" {
+			w.Header().Set("Content-Length", "1000")
+			w.Write([]byte("a"))
+			w.(http.Flusher).Flush()
+		}
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	out := filepath.Join(t.TempDir(), "out")
+	for _, c := range []struct {
+		path string
+		opts Options
+		msg  string
+	}{
+		{"/", Options{maxTime: 1}, "Operation timed out after"},
+		{"/stall", Options{speedLimit: 100, speedTime: 1}, "Operation too slow"},
+	} {
+		c.opts.method, c.opts.silent, c.opts.outputFilename = "GET", true, out
+		start := time.Now()
+		err := fetchUrl(globbedURL{url: srv.URL + c.path}, c.opts, newTransferStats(0), nil)
+		var timeoutErr *timeoutError
+		if !errors.As(err, &timeoutErr) || !strings.HasPrefix(err.Error(), c.msg) {
+			t.Errorf("Expected %q for %s, but got %v", c.msg, c.path, err)
+		}
+		if code := exitCodeFor(err); code != exitTimeout {
+			t.Errorf("Expected exit code %d for %s, but got %d", exitTimeout, c.path, code)
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("Expected %s to be aborted within 5s, but it took %s", c.path, elapsed)
+		}
+	}
+}
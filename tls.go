@@ -0,0 +1,387 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// tlsConfig builds the TLS configuration shared by every connection from the
+// TLS related options.
+func (o *Options) tlsConfig() (*tls.Config, error) {
+	cfg := &tls.Config{
+		InsecureSkipVerify: o.insecure,
+		KeyLogWriter:       o.keyLogWriter,
+	}
+
+	var err error
+	if cfg.MinVersion, cfg.MaxVersion, err = o.tlsVersions(); err != nil {
+		return nil, err
+	}
+	if o.ciphers != "" {
+		if cfg.CipherSuites, err = parseCiphers(o.ciphers); err != nil {
+			return nil, err
+		}
+	}
+	if o.curves != "" {
+		if cfg.CurvePreferences, err = parseCurves(o.curves); err != nil {
+			return nil, err
+		}
+	}
+
+	// cURL replaces the default CA bundle with the one given, rather than
+	// adding to it.
+	if o.caCert != "" || o.caPath != "" {
+		pool, err := loadCertPool(o.caCert, o.caPath)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = pool
+	}
+
+	// VerifyConnection is called even when -k skips the verification of
+	// the certificate chain, so these checks are always enforced.
+	var checks []func(tls.ConnectionState) error
+	if o.pinnedPubKey != "" {
+		pins, err := parsePinnedPubKey(o.pinnedPubKey)
+		if err != nil {
+			return nil, err
+		}
+		checks = append(checks, func(cs tls.ConnectionState) error {
+			return checkPinnedPubKey(cs.PeerCertificates, pins)
+		})
+	}
+	if o.certStatus {
+		checks = append(checks, checkCertStatus)
+	}
+	if len(checks) > 0 {
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			for _, check := range checks {
+				if err := check(cs); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+
+	if o.cert != "" {
+		cert, err := loadClientCertificate(o.cert, o.key, o.certType, o.pass)
+		if err != nil {
+			return nil, err
+		}
+		cfg.GetClientCertificate = func(cri *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			if ts := tracerFromContext(cri.Context()); ts != nil {
+				ts.clientCert = cert.Leaf
+			}
+			return cert, nil
+		}
+	}
+
+	return cfg, nil
+}
+
+// openKeyLog opens the file to log the TLS session secrets to, warning about
+// it. It returns nil when no key log is requested.
+func (o *Options) openKeyLog() (io.WriteCloser, error) {
+	file := o.keyLogFile()
+	if file == "" {
+		return nil, nil
+	}
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open the TLS key log file; %s", err)
+	}
+	Status.Printf(" WARNING: the TLS session secrets are logged to %s, anyone who can read it can decrypt the traffic\n", file)
+	return f, nil
+}
+
+// keyLogFile returns the file to log the TLS session secrets to, in the NSS
+// key log format, from --keylog or the SSLKEYLOGFILE environment variable.
+func (o *Options) keyLogFile() string {
+	if o.keyLog != "" {
+		return o.keyLog
+	}
+	return os.Getenv("SSLKEYLOGFILE")
+}
+
+// tlsVersions returns the minimum and maximum TLS versions to negotiate. Zero
+// values leave the choice to the Go defaults. As Go doesn't offer TLS 1.0 and
+// 1.1 unless asked to, a maximum below TLS 1.2 lowers the minimum to TLS 1.0.
+func (o *Options) tlsVersions() (uint16, uint16, error) {
+	var min, max uint16
+	switch {
+	case o.tlsv13:
+		min = tls.VersionTLS13
+	case o.tlsv12:
+		min = tls.VersionTLS12
+	case o.tlsv11:
+		min = tls.VersionTLS11
+	case o.tlsv10:
+		min = tls.VersionTLS10
+	}
+
+	switch o.tlsMax {
+	case "", "default":
+	case "1.0":
+		max = tls.VersionTLS10
+	case "1.1":
+		max = tls.VersionTLS11
+	case "1.2":
+		max = tls.VersionTLS12
+	case "1.3":
+		max = tls.VersionTLS13
+	default:
+		return 0, 0, fmt.Errorf("unsupported TLS version %q for --tls-max; expected 1.0, 1.1, 1.2 or 1.3", o.tlsMax)
+	}
+
+	if min == 0 && max != 0 && max < tls.VersionTLS12 {
+		min = tls.VersionTLS10
+	}
+	if min != 0 && max != 0 && max < min {
+		return 0, 0, errors.New("the maximum TLS version is lower than the minimum one")
+	}
+	return min, max, nil
+}
+
+// tlsLimits describes the TLS restrictions given on the command line, or
+// returns an empty string when there aren't any.
+func (o *Options) tlsLimits() string {
+	var limits []string
+	if min, max, err := o.tlsVersions(); err == nil {
+		if min != 0 {
+			limits = append(limits, "minimum "+tlsVersionName(min))
+		}
+		if max != 0 {
+			limits = append(limits, "maximum "+tlsVersionName(max))
+		}
+	}
+	if o.ciphers != "" {
+		limits = append(limits, "ciphers "+o.ciphers)
+	}
+	if o.curves != "" {
+		limits = append(limits, "curves "+o.curves)
+	}
+	return strings.Join(limits, ", ")
+}
+
+// isTLSHandshakeError reports whether err comes from a failed TLS handshake,
+// either refused by the peer with an alert, which Go reports as a "remote
+// error", or aborted with an alert or a malformed record. Certificates
+// which fail the verification aren't handshake errors.
+func isTLSHandshakeError(err error) bool {
+	var verr *tls.CertificateVerificationError
+	if errors.As(err, &verr) {
+		return false
+	}
+	var alert tls.AlertError
+	var recordErr tls.RecordHeaderError
+	var opErr *net.OpError
+	return errors.As(err, &alert) || errors.As(err, &recordErr) ||
+		(errors.As(err, &opErr) && opErr.Op == "remote error")
+}
+
+func tlsVersionName(v uint16) string {
+	switch v {
+	case tls.VersionTLS10:
+		return "TLSv1.0"
+	case tls.VersionTLS11:
+		return "TLSv1.1"
+	case tls.VersionTLS12:
+		return "TLSv1.2"
+	case tls.VersionTLS13:
+		return "TLSv1.3"
+	}
+	return fmt.Sprintf("0x%04x", v)
+}
+
+// errPinnedPubKey is returned when the public key of the peer doesn't match
+// the pinned ones.
+var errPinnedPubKey = errors.New("SSL: public key does not match pinned public key")
+
+// parsePinnedPubKey parses the --pinnedpubkey argument, which is either a
+// file holding a PEM or DER public key, or a list of base64 encoded SHA-256
+// hashes of public keys, "sha256//<hash>;sha256//<hash>". The SHA-256 hashes
+// of the pinned keys are returned.
+func parsePinnedPubKey(arg string) ([][sha256.Size]byte, error) {
+	var pins [][sha256.Size]byte
+
+	if strings.HasPrefix(arg, "sha256//") {
+		for _, p := range strings.Split(arg, ";") {
+			p = strings.TrimSpace(p)
+			if !strings.HasPrefix(p, "sha256//") {
+				return nil, fmt.Errorf("invalid pinned public key %q; expected sha256//<base64 hash>", p)
+			}
+			h, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(p, "sha256//"))
+			if err != nil || len(h) != sha256.Size {
+				return nil, fmt.Errorf("invalid pinned public key hash %q", p)
+			}
+			var pin [sha256.Size]byte
+			copy(pin[:], h)
+			pins = append(pins, pin)
+		}
+		return pins, nil
+	}
+
+	data, err := ioutil.ReadFile(arg)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the pinned public key; %s", err)
+	}
+	if block, _ := pem.Decode(data); block != nil {
+		if block.Type != "PUBLIC KEY" {
+			return nil, fmt.Errorf("unexpected %s in the pinned public key file; expected a PUBLIC KEY", block.Type)
+		}
+		data = block.Bytes
+	}
+	if _, err := x509.ParsePKIXPublicKey(data); err != nil {
+		return nil, fmt.Errorf("unable to parse the pinned public key; %s", err)
+	}
+	return append(pins, sha256.Sum256(data)), nil
+}
+
+// checkPinnedPubKey checks that the public key of the leaf certificate, the
+// first one sent by the peer, matches one of the pins. As in cURL, the other
+// certificates of the chain are ignored : with -k, anyone could send them.
+func checkPinnedPubKey(certs []*x509.Certificate, pins [][sha256.Size]byte) error {
+	if len(certs) == 0 {
+		return errPinnedPubKey
+	}
+	h := sha256.Sum256(certs[0].RawSubjectPublicKeyInfo)
+	for _, pin := range pins {
+		if h == pin {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w; the server presented sha256//%s", errPinnedPubKey, pubKeyHash(certs[0]))
+}
+
+// pubKeyHash returns the base64 encoded SHA-256 hash of the public key of
+// cert, in the format used by --pinnedpubkey.
+func pubKeyHash(cert *x509.Certificate) string {
+	h := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// loadCertPool reads the trusted CA certificates from a PEM bundle and/or
+// from every PEM file of a directory.
+func loadCertPool(file, dir string) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+
+	if file != "" {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read the CA certificates; %s", err)
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no valid CA certificate found in %s", file)
+		}
+	}
+
+	if dir != "" {
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read the CA certificates directory; %s", err)
+		}
+		for _, e := range entries {
+			if e.IsDir() {
+				continue
+			}
+			// Files which aren't PEM certificates, like the hash links of
+			// c_rehash pointing to certificates already read, are skipped.
+			if data, err := ioutil.ReadFile(filepath.Join(dir, e.Name())); err == nil {
+				pool.AppendCertsFromPEM(data)
+			}
+		}
+	}
+
+	return pool, nil
+}
+
+// loadClientCertificate loads the client certificate and its private key. As
+// in cURL, the password can be appended to the certificate file name after a
+// colon instead of being passed with --pass.
+func loadClientCertificate(certFile, keyFile, certType, pass string) (*tls.Certificate, error) {
+	if name, p, ok := strings.Cut(certFile, ":"); ok {
+		if _, err := os.Stat(certFile); err != nil {
+			certFile, pass = name, p
+		}
+	}
+
+	data, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the client certificate; %s", err)
+	}
+
+	var cert tls.Certificate
+	switch strings.ToUpper(certType) {
+	case "", "PEM":
+		keyData := data
+		if keyFile != "" {
+			if keyData, err = ioutil.ReadFile(keyFile); err != nil {
+				return nil, fmt.Errorf("unable to read the private key; %s", err)
+			}
+		}
+		if keyData, err = decryptPEMKey(keyData, pass); err != nil {
+			return nil, err
+		}
+		if cert, err = tls.X509KeyPair(data, keyData); err != nil {
+			return nil, fmt.Errorf("unable to load the client certificate; %s", err)
+		}
+	case "P12":
+		key, leaf, chain, err := pkcs12.DecodeChain(data, pass)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load the PKCS#12 client certificate; %s", err)
+		}
+		cert.PrivateKey = key
+		cert.Certificate = append(cert.Certificate, leaf.Raw)
+		for _, c := range chain {
+			cert.Certificate = append(cert.Certificate, c.Raw)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported certificate type %q; expected PEM or P12", certType)
+	}
+
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return nil, fmt.Errorf("unable to parse the client certificate; %s", err)
+	}
+	return &cert, nil
+}
+
+// decryptPEMKey decrypts the legacy encrypted PEM private keys found in data,
+// leaving every other block untouched.
+func decryptPEMKey(data []byte, pass string) ([]byte, error) {
+	var out []byte
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		// Deprecated in the standard library, but still what "openssl rsa
+		// -des3" produces.
+		if x509.IsEncryptedPEMBlock(block) {
+			if pass == "" {
+				return nil, errors.New("the private key is encrypted; a passphrase is required")
+			}
+			der, err := x509.DecryptPEMBlock(block, []byte(pass))
+			if err != nil {
+				return nil, fmt.Errorf("unable to decrypt the private key; %s", err)
+			}
+			block = &pem.Block{Type: block.Type, Bytes: der}
+		}
+		out = append(out, pem.EncodeToMemory(block)...)
+	}
+	return out, nil
+}
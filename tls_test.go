@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+func TestKeyLog(t *testing.T) {
+	t.Log("Testing --keylog... (expecting the secrets of the connection in the NSS format)")
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	setProxyEnv(t, nil)
+	var status bytes.Buffer
+	Status.SetOutput(&status)
+	defer Status.SetOutput(os.Stderr)
+
+	// The file is opened once, by the groups with different transports.
+	dir := t.TempDir()
+	file := filepath.Join(dir, "keys.log")
+	opts := Options{method: "GET", silent: true, keyLog: file, insecure: true, outputFilename: filepath.Join(dir, "1")}
+	http11 := Options{method: "GET", silent: true, keyLog: file, insecure: true, http11: true, outputFilename: filepath.Join(dir, "2")}
+	if err := run([]urlGroup{{&opts, []string{srv.URL}}, {&http11, []string{srv.URL}}}); err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(status.String(), "WARNING: the TLS session secrets"); n != 1 {
+		t.Errorf("Expected a single warning, but got %q", status.String())
+	}
+
+	data, _ := ioutil.ReadFile(file)
+	if n := strings.Count(string(data), "CLIENT_TRAFFIC_SECRET_0 "); n != 2 {
+		t.Errorf("Expected the TLS 1.3 traffic secrets of both connections, but got %q", data)
+	}
+
+	t.Setenv("SSLKEYLOGFILE", "env.log")
+	if f := (&Options{}).keyLogFile(); f != "env.log" {
+		t.Errorf("Expected the file of SSLKEYLOGFILE, but got %q", f)
+	}
+	if f := opts.keyLogFile(); f != file {
+		t.Errorf("Expected --keylog to take precedence, but got %q", f)
+	}
+}
+
+func TestTLSVersions(t *testing.T) {
+	t.Log("Testing tlsVersions()... (expecting --tls-max below 1.2 to allow TLS 1.0)")
+
+	for _, c := range []struct {
+		opts     Options
+		min, max uint16
+	}{
+		{Options{}, 0, 0},
+		{Options{tlsMax: "1.1"}, tls.VersionTLS10, tls.VersionTLS11},
+		{Options{tlsMax: "1.0"}, tls.VersionTLS10, tls.VersionTLS10},
+		{Options{tlsMax: "1.1", tlsv11: true}, tls.VersionTLS11, tls.VersionTLS11},
+		{Options{tlsMax: "1.2"}, 0, tls.VersionTLS12},
+		{Options{tlsv12: true}, tls.VersionTLS12, 0},
+	} {
+		min, max, err := c.opts.tlsVersions()
+		if err != nil || min != c.min || max != c.max {
+			t.Errorf("Expected %s to %s for --tls-max %q, but got %#04x to %#04x (%v)",
+				tlsVersionName(c.min), tlsVersionName(c.max), c.opts.tlsMax, min, max, err)
+		}
+	}
+	if _, _, err := (&Options{tlsMax: "1.1", tlsv12: true}).tlsVersions(); err == nil {
+		t.Error("Expected an error for a maximum lower than the minimum")
+	}
+}
+
+func TestLegacyTLS(t *testing.T) {
+	t.Log("Testing --tls-max 1.1... (expecting to reach a TLS 1.1 server, and a handshake error from a TLS 1.2 one)")
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	legacy := httptest.NewUnstartedServer(handler)
+	legacy.TLS = &tls.Config{MinVersion: tls.VersionTLS10, MaxVersion: tls.VersionTLS11}
+	legacy.StartTLS()
+	defer legacy.Close()
+	modern := httptest.NewUnstartedServer(handler)
+	modern.TLS = &tls.Config{MinVersion: tls.VersionTLS12}
+	modern.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	modern.StartTLS()
+	defer modern.Close()
+
+	cfg, err := (&Options{tlsMax: "1.1", insecure: true}).tlsConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &http.Client{Transport: &http.Transport{TLSClientConfig: cfg}}
+
+	resp, err := c.Get(legacy.URL)
+	if err != nil {
+		t.Fatalf("Expected the TLS 1.1 server to be reached, but got %s", err)
+	}
+	resp.Body.Close()
+	if resp.TLS.Version != tls.VersionTLS11 {
+		t.Errorf("Expected TLSv1.1, but got %s", tlsVersionName(resp.TLS.Version))
+	}
+
+	if _, err = c.Get(modern.URL); err == nil || !isTLSHandshakeError(err) {
+		t.Errorf("Expected a TLS handshake error, but got %v", err)
+	}
+	if isTLSHandshakeError(&tls.CertificateVerificationError{}) || isTLSHandshakeError(errors.New("tls: something")) {
+		t.Error("Expected only the typed handshake errors to be recognized")
+	}
+}
+
+// newTestCertificate returns a self-signed certificate for name.
+func newTestCertificate(t *testing.T, name string) *x509.Certificate {
+	cert, _ := newTestKeyPair(t, name)
+	return cert
+}
+
+// newTestKeyPair returns a self-signed certificate for name and its private
+// key.
+func newTestKeyPair(t *testing.T, name string) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func TestParsePinnedPubKey(t *testing.T) {
+	t.Log("Testing parsePinnedPubKey()... (expecting hashes, PEM and DER public keys)")
+
+	cert := newTestCertificate(t, "server")
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+
+	pins, err := parsePinnedPubKey("sha256//" + pubKeyHash(cert) + "; sha256//" + base64.StdEncoding.EncodeToString(make([]byte, 32)))
+	if err != nil || len(pins) != 2 || pins[0] != hash {
+		t.Errorf("Expected the 2 hashes, but got %x (%v)", pins, err)
+	}
+
+	dir := t.TempDir()
+	pemFile, derFile := filepath.Join(dir, "key.pem"), filepath.Join(dir, "key.der")
+	ioutil.WriteFile(pemFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: cert.RawSubjectPublicKeyInfo}), 0600)
+	ioutil.WriteFile(derFile, cert.RawSubjectPublicKeyInfo, 0600)
+	for _, file := range []string{pemFile, derFile} {
+		if pins, err := parsePinnedPubKey(file); err != nil || len(pins) != 1 || pins[0] != hash {
+			t.Errorf("Expected the hash of the key in %s, but got %x (%v)", file, pins, err)
+		}
+	}
+
+	for _, arg := range []string{"sha256//notbase64!", "sha256//" + pubKeyHash(cert) + ";md5//abc", filepath.Join(dir, "missing")} {
+		if _, err := parsePinnedPubKey(arg); err == nil {
+			t.Errorf("Expected an error for %q", arg)
+		}
+	}
+}
+
+func TestCheckPinnedPubKey(t *testing.T) {
+	t.Log("Testing checkPinnedPubKey()... (expecting only the leaf certificate to be matched)")
+
+	server, attacker := newTestCertificate(t, "server"), newTestCertificate(t, "attacker")
+	pins, err := parsePinnedPubKey("sha256//" + pubKeyHash(server))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := checkPinnedPubKey([]*x509.Certificate{server, attacker}, pins); err != nil {
+		t.Errorf("Expected the leaf to match, but got %s", err)
+	}
+	// The certificate of the server appended to the one of an attacker,
+	// which -k would accept.
+	if err := checkPinnedPubKey([]*x509.Certificate{attacker, server}, pins); !errors.Is(err, errPinnedPubKey) {
+		t.Errorf("Expected a mismatch with an appended certificate, but got %v", err)
+	}
+	if err := checkPinnedPubKey(nil, pins); !errors.Is(err, errPinnedPubKey) {
+		t.Errorf("Expected a mismatch without certificate, but got %v", err)
+	}
+}
+
+// writeTestKeyPair writes cert and key to PEM files in dir, the key being
+// encrypted with pass unless it is empty. It returns the file names.
+func writeTestKeyPair(t *testing.T, dir string, cert *x509.Certificate, key *ecdsa.PrivateKey, pass string) (string, string) {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := &pem.Block{Type: "EC PRIVATE KEY", Bytes: der}
+	if pass != "" {
+		if block, err = x509.EncryptPEMBlock(rand.Reader, block.Type, der, []byte(pass), x509.PEMCipherAES256); err != nil {
+			t.Fatal(err)
+		}
+	}
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(block), 0600)
+	return certFile, keyFile
+}
+
+func TestLoadClientCertificate(t *testing.T) {
+	t.Log("Testing loadClientCertificate()... (expecting PEM and PKCS#12 certificates, with their password)")
+
+	cert, key := newTestKeyPair(t, "client")
+	dir := t.TempDir()
+	certFile, keyFile := writeTestKeyPair(t, dir, cert, key, "")
+	encDir := t.TempDir()
+	encCertFile, encKeyFile := writeTestKeyPair(t, encDir, cert, key, "secret")
+
+	// The certificate and the key in the same file.
+	both := filepath.Join(dir, "both.pem")
+	certPEM, _ := ioutil.ReadFile(certFile)
+	keyPEM, _ := ioutil.ReadFile(keyFile)
+	ioutil.WriteFile(both, append(certPEM, keyPEM...), 0600)
+
+	p12, err := pkcs12.Modern.Encode(key, cert, nil, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p12File := filepath.Join(dir, "cert.p12")
+	ioutil.WriteFile(p12File, p12, 0600)
+
+	for _, c := range []struct {
+		cert, key, certType, pass string
+	}{
+		{certFile, keyFile, "", ""},
+		{both, "", "PEM", ""},
+		{encCertFile, encKeyFile, "", "secret"},
+		{encCertFile + ":secret", encKeyFile, "", ""},
+		{p12File, "", "P12", "secret"},
+		{p12File + ":secret", "", "p12", ""},
+	} {
+		got, err := loadClientCertificate(c.cert, c.key, c.certType, c.pass)
+		if err != nil {
+			t.Errorf("Expected %s to load, but got %s", c.cert, err)
+			continue
+		}
+		if !got.Leaf.Equal(cert) || got.PrivateKey == nil {
+			t.Errorf("Expected the certificate and the key of %s, but got %s", c.cert, got.Leaf.Subject)
+		}
+	}
+
+	for _, c := range []struct {
+		cert, key, certType, pass, expected string
+	}{
+		{encCertFile, encKeyFile, "", "", "a passphrase is required"},
+		{encCertFile, encKeyFile, "", "wrong", "unable to decrypt the private key"},
+		{p12File, "", "P12", "wrong", "unable to load the PKCS#12 client certificate"},
+		{certFile, keyFile, "DER", "", "unsupported certificate type"},
+		{filepath.Join(dir, "missing.pem"), "", "", "", "unable to read the client certificate"},
+	} {
+		if _, err := loadClientCertificate(c.cert, c.key, c.certType, c.pass); err == nil || !strings.Contains(err.Error(), c.expected) {
+			t.Errorf("Expected %q for %s, but got %v", c.expected, c.cert, err)
+		}
+	}
+}
+
+func TestLoadCertPool(t *testing.T) {
+	t.Log("Testing loadCertPool()... (expecting the certificates of --cacert and of the PEM files of --capath)")
+
+	bundleCert, dirCert := newTestCertificate(t, "bundle"), newTestCertificate(t, "capath")
+	bundle := filepath.Join(t.TempDir(), "ca.pem")
+	ioutil.WriteFile(bundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: bundleCert.Raw}), 0600)
+	dir := t.TempDir()
+	ioutil.WriteFile(filepath.Join(dir, "ca.pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: dirCert.Raw}), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "README"), []byte("not a certificate"), 0600)
+
+	pool, err := loadCertPool(bundle, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cert := range []*x509.Certificate{bundleCert, dirCert} {
+		if _, err := cert.Verify(x509.VerifyOptions{Roots: pool}); err != nil {
+			t.Errorf("Expected %s to be trusted, but got %s", cert.Subject, err)
+		}
+	}
+
+	if _, err := loadCertPool(filepath.Join(dir, "README"), ""); err == nil {
+		t.Error("Expected an error for a bundle without certificates")
+	}
+	if _, err := loadCertPool("", filepath.Join(dir, "missing")); err == nil {
+		t.Error("Expected an error for a missing --capath")
+	}
+}
+
+func TestClientCertificate(t *testing.T) {
+	t.Log("Testing -E, --cert... (expecting the client certificate to be sent and shown with -v)")
+
+	setProxyEnv(t, nil)
+	cert, key := newTestKeyPair(t, "client")
+	certFile, keyFile := writeTestKeyPair(t, t.TempDir(), cert, key, "secret")
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: pool}
+	srv.StartTLS()
+	defer srv.Close()
+
+	var status bytes.Buffer
+	Status.SetOutput(&status)
+	defer Status.SetOutput(os.Stderr)
+
+	tr, err := (&Options{cert: certFile + ":secret", key: keyFile, insecure: true}).newTransport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest("GET", srv.URL, nil)
+	resp, err := (&http.Client{Transport: tr}).Do(traceRequest(req))
+	if err != nil {
+		t.Fatalf("Expected the server to accept the certificate, but got %s", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "client" {
+		t.Errorf("Expected the server to see the client certificate, but got %q", body)
+	}
+	for _, s := range []string{"* Client certificate:\n", "*  subject: CN=client\n", "*  issuer: CN=client\n"} {
+		if !strings.Contains(status.String(), s) {
+			t.Errorf("Expected %q in the verbose output %q", s, status.String())
+		}
+	}
+
+	tr, _ = (&Options{insecure: true}).newTransport()
+	if resp, err := (&http.Client{Transport: tr}).Get(srv.URL); err == nil {
+		resp.Body.Close()
+		t.Error("Expected the server to require a client certificate")
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// cipherSuiteName returns the name of a cipher suite, the OpenSSL one used
+// by cURL when there is one, the IANA one otherwise.
+func cipherSuiteName(id uint16) string {
+	for name, cs := range opensslCiphers {
+		if cs == id {
+			return name
+		}
+	}
+	return tls.CipherSuiteName(id)
+}
+
+// peerChain returns the certificate chain of the peer, the verified one
+// when the verification took place, as sent by the peer otherwise.
+func peerChain(cs tls.ConnectionState) (chain []*x509.Certificate, verified bool) {
+	if len(cs.VerifiedChains) > 0 {
+		return cs.VerifiedChains[0], true
+	}
+	return cs.PeerCertificates, false
+}
+
+// publicKeyType describes the type and the size of the public key of cert,
+// like "RSA 2048 bits" or "ECDSA P-256".
+func publicKeyType(cert *x509.Certificate) string {
+	switch k := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		return fmt.Sprintf("RSA %d bits", k.N.BitLen())
+	case *ecdsa.PublicKey:
+		return "ECDSA " + k.Curve.Params().Name
+	case ed25519.PublicKey:
+		return "Ed25519"
+	}
+	return cert.PublicKeyAlgorithm.String()
+}
+
+// subjectAltNames returns the subject alternative names of cert, in the
+// OpenSSL format, like "DNS:example.com".
+func subjectAltNames(cert *x509.Certificate) []string {
+	var names []string
+	for _, n := range cert.DNSNames {
+		names = append(names, "DNS:"+n)
+	}
+	for _, ip := range cert.IPAddresses {
+		names = append(names, "IP:"+ip.String())
+	}
+	for _, e := range cert.EmailAddresses {
+		names = append(names, "email:"+e)
+	}
+	for _, u := range cert.URIs {
+		names = append(names, "URI:"+u.String())
+	}
+	return names
+}
+
+// errCertStatus is returned when --cert-status is given and the server
+// didn't staple a valid OCSP response stating that its certificate is good.
+var errCertStatus = errors.New("SSL: invalid certificate status")
+
+var errNoOCSPResponse = errors.New("no OCSP response stapled")
+
+// stapledOCSP parses the OCSP response stapled by the peer. Its signature is
+// checked against the issuer of the peer certificate, when known.
+func stapledOCSP(cs tls.ConnectionState) (*ocsp.Response, error) {
+	chain, _ := peerChain(cs)
+	if len(cs.OCSPResponse) == 0 || len(chain) == 0 {
+		return nil, errNoOCSPResponse
+	}
+	var issuer *x509.Certificate
+	if len(chain) > 1 {
+		issuer = chain[1]
+	}
+	return ocsp.ParseResponseForCert(cs.OCSPResponse, chain[0], issuer)
+}
+
+func ocspStatusName(status int) string {
+	switch status {
+	case ocsp.Good:
+		return "good"
+	case ocsp.Revoked:
+		return "revoked"
+	}
+	return "unknown"
+}
+
+// checkCertStatus implements --cert-status, which requires a stapled OCSP
+// response, currently valid, stating that the peer certificate is good.
+func checkCertStatus(cs tls.ConnectionState) error {
+	resp, err := stapledOCSP(cs)
+	if err != nil {
+		return fmt.Errorf("%w; %s", errCertStatus, err)
+	}
+	if resp.Status != ocsp.Good {
+		return fmt.Errorf("%w; the certificate status is %s", errCertStatus, ocspStatusName(resp.Status))
+	}
+	if !resp.NextUpdate.IsZero() && time.Now().After(resp.NextUpdate) {
+		return fmt.Errorf("%w; the OCSP response expired on %s", errCertStatus, resp.NextUpdate.Format(time.RFC1123))
+	}
+	return nil
+}
+
+// signedTimestamp is a Signed Certificate Timestamp of Certificate
+// Transparency, the promise of a log to publish the certificate.
+type signedTimestamp struct {
+	logID     []byte
+	timestamp time.Time
+	source    string // "TLS extension" or "certificate"
+}
+
+// oidSCTList is the X.509 extension holding the SCTs embedded in a
+// certificate.
+var oidSCTList = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 4, 2}
+
+// signedTimestamps returns the SCTs sent in the TLS handshake and the ones
+// embedded in the peer certificate. The SCTs which can't be parsed are
+// skipped.
+func signedTimestamps(cs tls.ConnectionState) []signedTimestamp {
+	var scts []signedTimestamp
+	for _, raw := range cs.SignedCertificateTimestamps {
+		if sct, ok := parseSCT(raw, "TLS extension"); ok {
+			scts = append(scts, sct)
+		}
+	}
+	if len(cs.PeerCertificates) == 0 {
+		return scts
+	}
+	for _, ext := range cs.PeerCertificates[0].Extensions {
+		if !ext.Id.Equal(oidSCTList) {
+			continue
+		}
+		var list []byte
+		if _, err := asn1.Unmarshal(ext.Value, &list); err != nil || len(list) < 2 {
+			break
+		}
+		// A list of SCTs, each prefixed with its length, prefixed with its
+		// total length, as in RFC 6962.
+		list = list[2:]
+		for len(list) >= 2 {
+			n := int(binary.BigEndian.Uint16(list))
+			if len(list) < 2+n {
+				break
+			}
+			if sct, ok := parseSCT(list[2:2+n], "certificate"); ok {
+				scts = append(scts, sct)
+			}
+			list = list[2+n:]
+		}
+	}
+	return scts
+}
+
+// parseSCT parses the version, log ID and timestamp of an SCT v1.
+func parseSCT(raw []byte, source string) (signedTimestamp, bool) {
+	if len(raw) < 1+32+8 || raw[0] != 0 {
+		return signedTimestamp{}, false
+	}
+	ms := int64(binary.BigEndian.Uint64(raw[33:41]))
+	return signedTimestamp{
+		logID:     raw[1:33],
+		timestamp: time.Unix(ms/1000, ms%1000*int64(time.Millisecond)).UTC(),
+		source:    source,
+	}, true
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+func TestCipherSuiteName(t *testing.T) {
+	t.Log("Testing cipherSuiteName()... (expecting OpenSSL names, then IANA names)")
+
+	for id, expected := range map[uint16]string{
+		tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256: "ECDHE-RSA-AES128-GCM-SHA256",
+		tls.TLS_AES_256_GCM_SHA384:                "TLS_AES_256_GCM_SHA384",
+		0x1234:                                    "0x1234",
+	} {
+		if got := cipherSuiteName(id); got != expected {
+			t.Errorf("Expected %s for %#04x, but got %s", expected, id, got)
+		}
+	}
+}
+
+func TestCheckCertStatus(t *testing.T) {
+	t.Log("Testing checkCertStatus()... (expecting only a good stapled response to pass)")
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	now := time.Now()
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, _ := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &key.PublicKey, key)
+	ca, _ := x509.ParseCertificate(caDER)
+	leafTmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		DNSNames:     []string{"example.com"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(time.Hour),
+	}
+	leafDER, _ := x509.CreateCertificate(rand.Reader, leafTmpl, ca, &key.PublicKey, key)
+	leaf, _ := x509.ParseCertificate(leafDER)
+
+	staple := func(status int) []byte {
+		resp, err := ocsp.CreateResponse(ca, ca, ocsp.Response{
+			Status:       status,
+			SerialNumber: leaf.SerialNumber,
+			ThisUpdate:   now.Add(-time.Minute),
+			NextUpdate:   now.Add(time.Hour),
+		}, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	cs := tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{leaf, ca}}, PeerCertificates: []*x509.Certificate{leaf, ca}}
+	if err := checkCertStatus(cs); !errors.Is(err, errCertStatus) {
+		t.Errorf("Expected an error without a response, but got %v", err)
+	}
+	cs.OCSPResponse = staple(ocsp.Revoked)
+	if err := checkCertStatus(cs); !errors.Is(err, errCertStatus) {
+		t.Errorf("Expected an error for a revoked certificate, but got %v", err)
+	}
+	cs.OCSPResponse = staple(ocsp.Good)
+	if err := checkCertStatus(cs); err != nil {
+		t.Errorf("Expected no error for a good certificate, but got %s", err)
+	}
+
+	if names := subjectAltNames(leaf); len(names) != 1 || names[0] != "DNS:example.com" {
+		t.Errorf("Unexpected subject alternative names %v", names)
+	}
+	if kt := publicKeyType(leaf); kt != "ECDSA P-256" {
+		t.Errorf("Expected an ECDSA P-256 key, but got %s", kt)
+	}
+}
+
+func TestParseSCT(t *testing.T) {
+	t.Log("Testing parseSCT()... (expecting the log ID and the timestamp)")
+
+	raw := make([]byte, 1+32+8+2)
+	raw[1] = 0xab
+	binary.BigEndian.PutUint64(raw[33:], 1500000000123)
+
+	sct, ok := parseSCT(raw, "TLS extension")
+	if !ok || sct.logID[0] != 0xab || !sct.timestamp.Equal(time.Unix(1500000000, 123e6)) {
+		t.Errorf("Unexpected SCT %+v", sct)
+	}
+	if _, ok := parseSCT(raw[:20], "TLS extension"); ok {
+		t.Error("Expected a truncated SCT to be rejected")
+	}
+}
@@ -1,18 +1,26 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
 	"fmt"
 	"net"
 	"net/http"
 	"net/http/httptrace"
 	"strings"
+
+	"github.com/quic-go/quic-go"
 )
 
 type tracerStruct struct {
 	req         *http.Request
 	redirects   int
 	currentHost string
+	clientCert  *x509.Certificate // set when a client certificate is sent
+	forceProto  string            // protocol imposed by the round tripper, if any
+	proto       string            // protocol used on the current connection
 }
 
 func (ts *tracerStruct) DNSStart(dnsinfo httptrace.DNSStartInfo) {
@@ -20,12 +28,16 @@ func (ts *tracerStruct) DNSStart(dnsinfo httptrace.DNSStartInfo) {
 }
 
 func (ts *tracerStruct) ConnectStart(network, addr string) {
+	if network == "unix" {
+		Status.Printf("   Trying %s...\n", addr)
+		return
+	}
 	hs, _, _ := net.SplitHostPort(addr)
 	Status.Printf("   Trying %s...\n", hs)
 }
 
 func (ts *tracerStruct) WroteHeaders() {
-	fmt.Fprintln(Outgoing, ts.req.Method, ts.req.URL.Path, ts.req.Proto)
+	fmt.Fprintln(Outgoing, ts.req.Method, ts.req.URL.Path, ts.proto)
 	for k, v := range ts.req.Header {
 		fmt.Fprintln(Outgoing, k, v)
 	}
@@ -33,13 +45,37 @@ func (ts *tracerStruct) WroteHeaders() {
 }
 
 func (ts *tracerStruct) ConnectDone(network, addr string, err error) {
-	Status.Println(" TCP_NODELAY set")
+	if network == "unix" {
+		if err != nil {
+			Status.Printf(" connect to socket %s failed: %s\n", addr, err)
+			return
+		}
+		Status.Printf(" Connected to %s (%s) (#%d)\n", ts.currentHost, addr, ts.redirects)
+		ts.redirects += 1
+		return
+	}
+
 	hs, port, _ := net.SplitHostPort(addr)
+	if err != nil {
+		Status.Printf(" connect to %s port %s failed: %s\n", hs, port, err)
+		return
+	}
+	if network != "udp" {
+		Status.Println(" TCP_NODELAY set")
+	}
 	Status.Printf(" Connected to %s (%s) port %s (#%d)%s\n", ts.currentHost, hs, port, ts.redirects, ts.req.RequestURI)
 	ts.redirects += 1
 }
 
 func (ts *tracerStruct) GotConn(cinfo httptrace.GotConnInfo) {
+	ts.proto = "HTTP/1.1"
+	if tlsConn, ok := cinfo.Conn.(*tls.Conn); ok && tlsConn.ConnectionState().NegotiatedProtocol == "h2" {
+		ts.proto = "HTTP/2"
+	}
+	if ts.forceProto != "" {
+		ts.proto = ts.forceProto
+	}
+
 	if cinfo.Reused {
 		hs, port, _ := net.SplitHostPort(cinfo.Conn.RemoteAddr().String())
 		Status.Printf(" Re-using existing connection! (#%d) with host %s\n", ts.redirects-1, ts.currentHost)
@@ -48,47 +84,110 @@ func (ts *tracerStruct) GotConn(cinfo httptrace.GotConnInfo) {
 }
 
 func (ts *tracerStruct) TLSHandshakeDone(cstate tls.ConnectionState, err error) {
+	if err != nil {
+		Status.Printf(" TLS handshake failed: %s\n", err)
+		return
+	}
 	if !cstate.HandshakeComplete {
-		Status.Printf(" TLS Handshake not completed")
+		Status.Println(" TLS Handshake not completed")
 		return
 	}
-	var tlsversion, ciphersuite string
-	switch cstate.Version {
-	case tls.VersionSSL30:
-		tlsversion = "SSLv3"
-	case tls.VersionTLS10:
-		tlsversion = "TLSv1.0"
-	case tls.VersionTLS11:
-		tlsversion = "TLSv1.1"
-	case tls.VersionTLS12:
-		tlsversion = "TLSv1.2"
+	tlsversion := tlsVersionName(cstate.Version)
+	Status.Printf(" ALPN, server accepted to use %s\n", cstate.NegotiatedProtocol)
+	Status.Printf(" %s, TLS Handshake finished\n", tlsversion)
+	Status.Printf(" SSL connection using %s / %s\n", tlsversion, cipherSuiteName(cstate.CipherSuite))
+	ts.printCertificates(cstate)
+}
+
+// QUICHandshakeDone reports the QUIC connection established for HTTP/3, the
+// TLS handshake being part of the QUIC one.
+func (ts *tracerStruct) QUICHandshakeDone(cstate quic.ConnectionState) {
+	tlsversion := tlsVersionName(cstate.TLS.Version)
+	Status.Printf(" QUIC connection using version %s\n", cstate.Version)
+	Status.Printf(" ALPN, server accepted to use %s\n", cstate.TLS.NegotiatedProtocol)
+	Status.Printf(" %s, QUIC Handshake finished\n", tlsversion)
+	Status.Printf(" SSL connection using %s / %s\n", tlsversion, cipherSuiteName(cstate.TLS.CipherSuite))
+	if cstate.Used0RTT {
+		Status.Println(" 0-RTT data accepted")
 	}
+	ts.printCertificates(cstate.TLS)
+}
 
-	ciphersuite = getCipherSuiteString(cstate.CipherSuite)
-	Status.Printf(" APLN, server accepted to use %s", cstate.NegotiatedProtocol)
-	Status.Printf(" %s, TLS Handshake finished", tlsversion)
-	Status.Printf(" SSL connection using %s / %s", tlsversion, ciphersuite)
-	if len(cstate.PeerCertificates) > 0 {
-		cert := cstate.PeerCertificates[0]
+// printCertificates reports the server certificate and its chain, the one
+// verified or, with -k, the one sent by the server, the stapled OCSP
+// response, the Certificate Transparency timestamps and the client
+// certificate sent.
+func (ts *tracerStruct) printCertificates(cstate tls.ConnectionState) {
+	chain, verified := peerChain(cstate)
+	if len(chain) > 0 {
+		cert := chain[0]
 		Status.Println(" Server certificate:")
-		Status.Printf("  subject: CN=%s\n", cert.Subject.CommonName)
+		Status.Printf("  subject: %s\n", cert.Subject)
 		Status.Printf("  start date: %s\n", cert.NotBefore.Format("Mon, 02 Jan 2006 15:04:05 MST"))
 		Status.Printf("  expire date: %s\n", cert.NotAfter.Format("Mon, 02 Jan 2006 15:04:05 MST"))
-		Status.Printf("  issuer: C=%s; O=%s; CN=%s\n",
-			strings.Join(cert.Issuer.Country, " "),
-			strings.Join(cert.Issuer.Organization, " "),
-			cert.Issuer.CommonName)
-		Status.Printf("  SSL certificate verify ok.\n")
+		if names := subjectAltNames(cert); len(names) > 0 {
+			Status.Printf("  subjectAltName: %s\n", strings.Join(names, ", "))
+		}
+		Status.Printf("  public key: %s\n", publicKeyType(cert))
+		Status.Printf("  issuer: %s\n", cert.Issuer)
+		if verified {
+			Status.Println("  SSL certificate verify ok.")
+			Status.Println(" Certificate chain, as verified:")
+		} else {
+			Status.Println("  SSL certificate verification SKIPPED (-k, --insecure)")
+			Status.Println(" Certificate chain, as sent by the server:")
+		}
+		for i, c := range chain {
+			Status.Printf("  %d s:%s\n", i, c.Subject)
+			Status.Printf("    i:%s\n", c.Issuer)
+			Status.Printf("    %s key, signed using %s, expires %s\n", publicKeyType(c), c.SignatureAlgorithm,
+				c.NotAfter.Format("Mon, 02 Jan 2006 15:04:05 MST"))
+		}
+
+		switch resp, err := stapledOCSP(cstate); {
+		case err == errNoOCSPResponse:
+			Status.Println(" No OCSP response stapled")
+		case err != nil:
+			Status.Printf(" Invalid OCSP response stapled: %s\n", err)
+		default:
+			Status.Printf(" OCSP response: certificate status %s, updated %s\n", ocspStatusName(resp.Status),
+				resp.ThisUpdate.Format("Mon, 02 Jan 2006 15:04:05 MST"))
+		}
+
+		for _, sct := range signedTimestamps(cstate) {
+			Status.Printf(" SCT from the %s: log %s, timestamp %s\n", sct.source,
+				base64.StdEncoding.EncodeToString(sct.logID), sct.timestamp.Format("Mon, 02 Jan 2006 15:04:05 MST"))
+		}
+	}
+	if cert := ts.clientCert; cert != nil {
+		Status.Println(" Client certificate:")
+		Status.Printf("  subject: %s\n", cert.Subject)
+		Status.Printf("  expire date: %s\n", cert.NotAfter.Format("Mon, 02 Jan 2006 15:04:05 MST"))
+		Status.Printf("  issuer: %s\n", cert.Issuer)
 	}
 }
 
-func NewClientTraceForRequest(req *http.Request) *httptrace.ClientTrace {
+type tracerKey struct{}
+
+// traceRequest returns a copy of req carrying the verbose client trace in its
+// context. The tracer itself is also stored in the context, so the parts of
+// the connection setup which aren't covered by httptrace can report to it.
+func traceRequest(req *http.Request) *http.Request {
 	if req == nil {
 		Status.Fatal("cannot do a verbose trace for a empty request")
 	}
 
 	ts := &tracerStruct{req: req}
+	ctx := context.WithValue(req.Context(), tracerKey{}, ts)
+	return req.WithContext(httptrace.WithClientTrace(ctx, NewClientTraceForRequest(ts)))
+}
+
+func tracerFromContext(ctx context.Context) *tracerStruct {
+	ts, _ := ctx.Value(tracerKey{}).(*tracerStruct)
+	return ts
+}
 
+func NewClientTraceForRequest(ts *tracerStruct) *httptrace.ClientTrace {
 	return &httptrace.ClientTrace{
 		ConnectStart:     ts.ConnectStart,
 		ConnectDone:      ts.ConnectDone,
@@ -98,53 +197,3 @@ func NewClientTraceForRequest(req *http.Request) *httptrace.ClientTrace {
 		TLSHandshakeDone: ts.TLSHandshakeDone,
 	}
 }
-
-func getCipherSuiteString(num uint16) string {
-	switch num {
-	case tls.TLS_RSA_WITH_RC4_128_SHA:
-		return "RSA-RC4-128-SHA"
-	case tls.TLS_RSA_WITH_3DES_EDE_CBC_SHA:
-		return "RSA-3DES-EDE-CBC-SHA"
-	case tls.TLS_RSA_WITH_AES_128_CBC_SHA:
-		return "RSA-AES-128-CBC-SHA"
-	case tls.TLS_RSA_WITH_AES_256_CBC_SHA:
-		return "RSA-AES-256-CBC-SHA"
-	case tls.TLS_RSA_WITH_AES_128_CBC_SHA256:
-		return "RSA-AES-128-CBC-SHA256"
-	case tls.TLS_RSA_WITH_AES_128_GCM_SHA256:
-		return "RSA-AES-128-GCM-SHA256"
-	case tls.TLS_RSA_WITH_AES_256_GCM_SHA384:
-		return "RSA-AES-256-GCM-SHA384"
-	case tls.TLS_ECDHE_ECDSA_WITH_RC4_128_SHA:
-		return "ECDHE-ECDSA-RC4-128-SHA"
-	case tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA:
-		return "ECDHE-ECDSA-AES-128-CBC-SHA"
-	case tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA:
-		return "ECDHE-ECDSA-AES-256-CBC-SHA"
-	case tls.TLS_ECDHE_RSA_WITH_RC4_128_SHA:
-		return "ECDHE-RSA-RC4-128-SHA"
-	case tls.TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA:
-		return "ECDHE-RSA-3DES-EDE-CBC-SHA"
-	case tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA:
-		return "ECDHE-RSA-AES-128-CBC-SHA"
-	case tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA:
-		return "ECDHE-RSA-AES-256-CBC-SHA"
-	case tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256:
-		return "ECDHE-ECDSA-AES-128-CBCSHA256"
-	case tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256:
-		return "ECDHE-RSA-AES-128-CBC-SHA256"
-	case tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256:
-		return "ECDHE-RSA-AES-128-GCM-SHA256"
-	case tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256:
-		return "ECDHE-ECDSA-AES-128-GCM-SHA256"
-	case tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384:
-		return "ECDHE-RSA-AES-256-GCM-SHA384"
-	case tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384:
-		return "ECDHE-ECDSA-AES-256-GCM-SHA384"
-	case tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305:
-		return "ECDHE-RSA-CHACHA20-POLY1305"
-	case tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305:
-		return "ECDHE-ECDSA-CHACHA20-POLY1305"
-	}
-	return "FALLBACK-SCSV"
-}
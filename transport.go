@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// newTransport builds the transport shared by the transfers of the groups of
+// URLs with the same connection related options.
+func (o *Options) newTransport() (http.RoundTripper, error) {
+	router, err := o.newProxyRouter()
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig, err := o.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	overrides, err := parseHostOverrides(o.resolve, o.connectTo)
+	if err != nil {
+		return nil, err
+	}
+
+	connectTimeout, tlsTimeout := 30*time.Second, 10*time.Second
+	if o.connectTimeout > 0 {
+		connectTimeout = time.Duration(o.connectTimeout) * time.Second
+		tlsTimeout = connectTimeout
+	}
+	keepAlive := 30 * time.Second
+	if o.keepaliveTime > 0 {
+		keepAlive = time.Duration(o.keepaliveTime) * time.Second
+	}
+
+	d := &dialer{
+		Dialer: net.Dialer{
+			Timeout:   connectTimeout,
+			KeepAlive: keepAlive,
+		},
+		router:     router,
+		overrides:  overrides,
+		unixSocket: o.unixSocketPath(),
+		verbose:    o.verbose,
+		wire:       o.include || o.dumpHeader != "",
+		trace:      o.traceLog,
+	}
+
+	tr := &http.Transport{
+		Proxy:                 router.Proxy,
+		DialContext:           d.DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   tlsTimeout,
+		ExpectContinueTimeout: time.Duration(o.expectTimeout) * time.Second,
+		TLSClientConfig:       tlsConfig,
+		DisableCompression:    o.raw,
+	}
+
+	// Every connection goes to the socket, no proxy can be involved.
+	if d.unixSocket != "" {
+		tr.Proxy = nil
+	}
+
+	if o.verbose {
+		tr.OnProxyConnectResponse = traceProxyConnect
+	}
+
+	// The transport does the TLS handshake itself unless it is given a TLS
+	// dialer, which is needed to see the decrypted HTTP/1.x traffic. The
+	// dialer then tunnels through the HTTP proxies itself.
+	if d.wire || d.trace != nil {
+		tr.DialTLSContext = d.dialTLS(tr)
+		router.tunnel = true
+	}
+
+	rt, err := o.http3Transport(o.httpVersion(tr, d), tlsConfig, d)
+	if err != nil {
+		return nil, err
+	}
+	if router.settings.socks() && d.unixSocket == "" {
+		rt = &socksTransport{RoundTripper: rt, router: router}
+	}
+	return rt, nil
+}
+
+// connectionOptions returns the options of o which newTransport uses, so
+// that the groups of URLs with the same ones can share a transport.
+func (o *Options) connectionOptions() Options {
+	return Options{
+		verbose:        o.verbose,
+		connectTimeout: o.connectTimeout,
+		keepaliveTime:  o.keepaliveTime,
+		expectTimeout:  o.expectTimeout,
+		insecure:       o.insecure,
+		proxy:          o.proxy,
+		proxyUser:      o.proxyUser,
+		noProxy:        o.noProxy,
+		socks5:         o.socks5,
+		socks5Hostname: o.socks5Hostname,
+		caCert:         o.caCert,
+		caPath:         o.caPath,
+		cert:           o.cert,
+		certType:       o.certType,
+		key:            o.key,
+		pass:           o.pass,
+		tlsv10:         o.tlsv10,
+		tlsv11:         o.tlsv11,
+		tlsv12:         o.tlsv12,
+		tlsv13:         o.tlsv13,
+		tlsMax:         o.tlsMax,
+		ciphers:        o.ciphers,
+		curves:         o.curves,
+		pinnedPubKey:   o.pinnedPubKey,
+		certStatus:     o.certStatus,
+		keyLog:         o.keyLog,
+		resolve:        o.resolve,
+		connectTo:      o.connectTo,
+		unixSocket:     o.unixSocket,
+		abstractSocket: o.abstractSocket,
+		http10:         o.http10,
+		http11:         o.http11,
+		http2:          o.http2,
+		priorKnowledge: o.priorKnowledge,
+		http3:          o.http3,
+		http3Only:      o.http3Only,
+		altSvc:         o.altSvc,
+		raw:            o.raw,
+		dumpHeader:     o.dumpHeader,
+		include:        o.include,
+		traceLog:       o.traceLog,
+	}
+}
+
+// dialer opens the connections of the transport, either directly or through
+// a SOCKS proxy, applying the --connect-to and --resolve overrides. When a
+// Unix domain socket is given, all the connections are made to it instead.
+// With wire set, the connections capture the response headers as received,
+// and with trace, they dump everything sent and received.
+type dialer struct {
+	net.Dialer
+	router     *proxyRouter
+	overrides  *hostOverrides
+	unixSocket string
+	verbose    bool
+	wire       bool
+	trace      *traceLog
+}
+
+func (d *dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := d.dial(ctx, network, addr)
+	if err != nil {
+		// Unless it is the whole transfer which timed out.
+		if isTimeout(err) && ctx.Err() == nil {
+			err = &timeoutError{
+				msg: fmt.Sprintf("Connection timed out after %d milliseconds", d.Timeout.Milliseconds()),
+				err: err,
+			}
+		}
+		return nil, err
+	}
+	return d.wrap(conn), nil
+}
+
+// wrap returns conn, which carries HTTP in the clear, with the header capture
+// and the trace requested.
+func (d *dialer) wrap(conn net.Conn) net.Conn {
+	if d.trace != nil {
+		conn = d.trace.newConn(conn)
+	}
+	if d.wire {
+		conn = newWireConn(conn)
+	}
+	return conn
+}
+
+func (d *dialer) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	if d.unixSocket != "" {
+		if ts := tracerFromContext(ctx); ts != nil {
+			ts.currentHost, _, _ = net.SplitHostPort(addr)
+		}
+		return d.Dialer.DialContext(ctx, "unix", d.unixSocket)
+	}
+
+	p := socksProxyFromContext(ctx)
+
+	if to := d.overrides.redirect(addr); to != addr {
+		if d.verbose {
+			Status.Printf(" Connecting to hostname: %s\n", to)
+		}
+		addr = to
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if ts := tracerFromContext(ctx); ts != nil {
+		ts.currentHost = host
+	}
+
+	addrs := []string{addr}
+	if ips := d.overrides.lookup(addr); len(ips) > 0 {
+		if d.verbose {
+			Status.Printf(" Hostname %s was found in DNS cache\n", host)
+		}
+		addrs = addrs[:0]
+		for _, ip := range ips {
+			addrs = append(addrs, net.JoinHostPort(ip, port))
+		}
+		// Let the SOCKS proxy connect to the given address rather than
+		// resolving the host name itself.
+		addr = addrs[0]
+	}
+
+	if p != nil {
+		return dialSocks(ctx, &d.Dialer, p, network, addr, d.verbose)
+	}
+
+	var conn net.Conn
+	for _, a := range addrs {
+		if conn, err = d.Dialer.DialContext(ctx, network, a); err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// unixSocketPath returns the Unix domain socket to connect to, if any.
+// Abstract sockets are Linux specific, their name is prefixed with "@".
+func (o *Options) unixSocketPath() string {
+	if o.abstractSocket != "" {
+		return "@" + o.abstractSocket
+	}
+	return o.unixSocket
+}
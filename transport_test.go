@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+func TestUnixSocket(t *testing.T) {
+	t.Log("Testing --unix-socket... (expecting every request, redirects included, to go to the socket)")
+
+	setProxyEnv(t, nil)
+	dir := t.TempDir()
+	socket := filepath.Join(dir, "kurly.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Skipf("Unix domain sockets aren't available : %s", err)
+	}
+
+	var conns int32
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/old":
+			http.Redirect(w, r, "/new", http.StatusFound)
+			return
+		case "/elsewhere":
+			http.Redirect(w, r, "http://other.invalid/new", http.StatusFound)
+			return
+		}
+		w.Write([]byte(r.Host + r.URL.Path))
+	}))
+	srv.Listener.Close()
+	srv.Listener = l
+	srv.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+
+	// The hosts can't be resolved, only the socket can serve them. The
+	// connection is reused for the redirects to the same host.
+	for i, c := range []struct {
+		url, expected string
+		conns         int32
+	}{
+		{"http://example.invalid/get", "example.invalid/get", 1},
+		{"http://example.invalid/old", "example.invalid/new", 1},
+		{"http://example.invalid/elsewhere", "other.invalid/new", 2},
+	} {
+		atomic.StoreInt32(&conns, 0)
+		out := filepath.Join(dir, fmt.Sprintf("out%d", i))
+		opts := &Options{method: "GET", silent: true, unixSocket: socket, followRedirect: true, maxRedirects: 5, outputFilename: out}
+		if err := run([]urlGroup{{opts, []string{c.url}}}); err != nil {
+			t.Fatalf("Expected %s to be fetched through the socket, but got %s", c.url, err)
+		}
+		if body, _ := ioutil.ReadFile(out); string(body) != c.expected {
+			t.Errorf("Expected %q for %s, but got %q", c.expected, c.url, body)
+		}
+		if n := atomic.LoadInt32(&conns); n != c.conns {
+			t.Errorf("Expected %d connections for %s, but got %d", c.conns, c.url, n)
+		}
+	}
+}
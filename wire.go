@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// wireConn is an HTTP/1.x connection, after the TLS decryption, which
+// extracts the header blocks of the responses read on it, exactly as they
+// were received. Each block is passed to the onHeader callback of the
+// request being served, set when the connection is handed to it.
+type wireConn struct {
+	net.Conn
+
+	mu       sync.Mutex
+	onHeader func(block []byte)
+	pending  [][]byte     // blocks read before any request got the connection
+	block    bytes.Buffer // block being read
+	state    int
+}
+
+const (
+	wireAwaiting = iota // a request was written, its response is expected
+	wireHeader          // reading a header block
+	wireBody            // reading a body, ignored
+	wireOpaque          // not HTTP/1.x, like a TLS tunnel through a proxy
+)
+
+func newWireConn(c net.Conn) *wireConn {
+	return &wireConn{Conn: c, state: wireBody}
+}
+
+func (c *wireConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	if c.state == wireBody {
+		c.state = wireAwaiting
+	}
+	c.mu.Unlock()
+	return c.Conn.Write(p)
+}
+
+func (c *wireConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.mu.Lock()
+		c.scan(p[:n])
+		c.mu.Unlock()
+	}
+	return n, err
+}
+
+// scan looks for the header blocks in the data read. The caller holds c.mu.
+func (c *wireConn) scan(data []byte) {
+	for len(data) > 0 {
+		switch c.state {
+		case wireAwaiting:
+			c.state = wireHeader
+			c.block.Reset()
+		case wireHeader:
+			c.block.Write(data)
+			data = nil
+			b := c.block.Bytes()
+			if !bytes.HasPrefix(b, []byte("HTTP/")) && len(b) >= len("HTTP/") {
+				c.state = wireOpaque
+				return
+			}
+			end := bytes.Index(b, []byte("\r\n\r\n"))
+			if end < 0 {
+				continue
+			}
+			end += len("\r\n\r\n")
+			block := append([]byte(nil), b[:end]...)
+			data = append([]byte(nil), b[end:]...)
+			c.deliver(block)
+
+			// An informational response, like 100 Continue, is followed by
+			// the final one.
+			if bytes.HasPrefix(block[len("HTTP/1.x "):], []byte("1")) {
+				c.state = wireAwaiting
+			} else {
+				c.state = wireBody
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (c *wireConn) deliver(block []byte) {
+	if c.onHeader == nil {
+		c.pending = append(c.pending, block)
+		return
+	}
+	c.onHeader(block)
+}
+
+// setOnHeader hands the connection to a request, passing it the blocks read
+// so far, like the response to a proxy CONNECT.
+func (c *wireConn) setOnHeader(f func(block []byte)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onHeader = f
+	for _, b := range c.pending {
+		f(b)
+	}
+	c.pending = nil
+}
+
+// connTLSState returns the state of the TLS connection under the wrappers
+// of conn, if any. The transport only reports it for a *tls.Conn.
+func connTLSState(conn net.Conn) *tls.ConnectionState {
+	for {
+		switch c := conn.(type) {
+		case *wireConn:
+			conn = c.Conn
+		case *traceConn:
+			conn = c.Conn
+		case *tls.Conn:
+			cs := c.ConnectionState()
+			return &cs
+		default:
+			return nil
+		}
+	}
+}
+
+// dialTLS opens a TLS connection like the transport itself does, with the
+// trace hooks. While tracing, only HTTP/1.1 is offered: the transport only
+// uses HTTP/2 on a *tls.Conn, whose decrypted frames can't be traced.
+func (d *dialer) dialTLS(tr *http.Transport) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		cfg := tr.TLSClientConfig.Clone()
+		if cfg.ServerName == "" {
+			cfg.ServerName, _, _ = net.SplitHostPort(addr)
+		}
+		if d.trace != nil {
+			cfg.NextProtos = []string{"http/1.1"}
+		}
+		return d.dialTLSConn(ctx, addr, cfg, tr.TLSHandshakeTimeout)
+	}
+}
+
+// dialTLSConn opens a TLS connection to addr with cfg, through the HTTP proxy
+// tunnel if there is one, and returns it wrapped by d.wrap. HTTP/2
+// connections are returned as is, since the transport only uses HTTP/2 on a
+// *tls.Conn.
+func (d *dialer) dialTLSConn(ctx context.Context, addr string, cfg *tls.Config, timeout time.Duration) (net.Conn, error) {
+	var conn net.Conn
+	var t *tunnel
+	var err error
+	if p := d.tunnelProxy(addr); p != nil {
+		if t, err = d.dialTunnel(ctx, p, addr, cfg, timeout); err == nil {
+			conn = t.Conn
+		}
+	} else {
+		conn, err = d.dial(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConn := tls.Client(conn, cfg)
+	trace := httptrace.ContextClientTrace(ctx)
+	if trace != nil && trace.TLSHandshakeStart != nil {
+		trace.TLSHandshakeStart()
+	}
+	err = tlsHandshake(ctx, tlsConn, timeout)
+	if trace != nil && trace.TLSHandshakeDone != nil {
+		trace.TLSHandshakeDone(tlsConn.ConnectionState(), err)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if tlsConn.ConnectionState().NegotiatedProtocol == "h2" {
+		return tlsConn, nil
+	}
+	if t != nil {
+		return t.wrap(tlsConn), nil
+	}
+	return d.wrap(tlsConn), nil
+}
+
+// tlsHandshake performs the TLS handshake of conn within timeout, as the
+// transport does.
+func tlsHandshake(ctx context.Context, conn *tls.Conn, timeout time.Duration) error {
+	if timeout <= 0 {
+		return conn.HandshakeContext(ctx)
+	}
+	hctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	err := conn.HandshakeContext(hctx)
+	if err != nil && ctx.Err() == nil && hctx.Err() == context.DeadlineExceeded {
+		err = &timeoutError{
+			msg: fmt.Sprintf("TLS handshake timed out after %d milliseconds", timeout.Milliseconds()),
+			err: err,
+		}
+	}
+	return err
+}
+
+// synthHeader returns the header block of a response which wasn't received
+// as HTTP/1.x, in the HTTP/1.x format. The HTTP/2 and HTTP/3 header names
+// are lower case, and their order is lost.
+func synthHeader(resp *http.Response) []byte {
+	var b bytes.Buffer
+	if resp.ProtoMajor >= 2 {
+		fmt.Fprintf(&b, "%s %d\r\n", protoName(resp), resp.StatusCode)
+	} else {
+		fmt.Fprintf(&b, "%s %s\r\n", resp.Proto, resp.Status)
+	}
+
+	keys := make([]string, 0, len(resp.Header))
+	for k := range resp.Header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		name := k
+		if resp.ProtoMajor >= 2 {
+			name = strings.ToLower(k)
+		}
+		for _, v := range resp.Header[k] {
+			fmt.Fprintf(&b, "%s: %s\r\n", name, v)
+		}
+	}
+	b.WriteString("\r\n")
+	return b.Bytes()
+}
+
+// writeHeaders writes the header blocks of every response of the last
+// attempt at the transfer, the redirects included, as received.
+func writeHeaders(w io.Writer, s *transferStats) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, h := range s.hops[s.firstHop:] {
+		blocks := h.rawHeaders
+		if len(blocks) == 0 && h.resp != nil {
+			blocks = [][]byte{synthHeader(h.resp)}
+		}
+		for _, b := range blocks {
+			if _, err := w.Write(b); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// openDumpHeader opens the --dump-header destination, "-" being stdout.
+func (o *Options) openDumpHeader() (io.WriteCloser, error) {
+	if o.dumpHeader == "-" {
+		return nopWriteCloser{os.Stdout}, nil
+	}
+	f, err := os.Create(o.dumpHeader)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open the header file; %s", err)
+	}
+	return f, nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWriteHeaders(t *testing.T) {
+	t.Log("Testing writeHeaders()... (expecting every header block as received)")
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		br := bufio.NewReader(conn)
+		for {
+			req, err := http.ReadRequest(br)
+			if err != nil {
+				return
+			}
+			if req.URL.Path == "/old" {
+				io.WriteString(conn, "HTTP/1.1 302 Found\r\nlocation: /new\r\nContent-Length: 0\r\n\r\n")
+				continue
+			}
+			io.WriteString(conn, "HTTP/1.1 200 OK\r\nZ-First: 1\r\nx-second: 2\r\nContent-Length: 2\r\n\r\nok")
+		}
+	}()
+
+	opts := Options{include: true}
+	tr, err := opts.newTransport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &http.Client{Transport: tr, CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		statsFromContext(req.Context()).redirect(req)
+		return nil
+	}}
+
+	stats := newTransferStats(0)
+	req, _ := http.NewRequest("GET", "http://"+ln.Addr().String()+"/old", nil)
+	resp, err := c.Do(stats.attach(req))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	stats.gotResponse(resp)
+
+	var buf bytes.Buffer
+	if err := writeHeaders(&buf, stats); err != nil {
+		t.Fatal(err)
+	}
+	expected := "HTTP/1.1 302 Found\r\nlocation: /new\r\nContent-Length: 0\r\n\r\n" +
+		"HTTP/1.1 200 OK\r\nZ-First: 1\r\nx-second: 2\r\nContent-Length: 2\r\n\r\n"
+	if buf.String() != expected {
+		t.Errorf("Expected %q, but got %q", expected, buf.String())
+	}
+}
+
+func TestWriteHeadersTLS(t *testing.T) {
+	t.Log("Testing writeHeaders()... (expecting the decrypted headers and the TLS state)")
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Test", "yes")
+		io.WriteString(w, "hello")
+	}))
+	defer srv.Close()
+
+	opts := Options{include: true, insecure: true, http11: true}
+	tr, err := opts.newTransport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &http.Client{Transport: tr}
+
+	stats := newTransferStats(0)
+	req, _ := http.NewRequest("GET", srv.URL, nil)
+	resp, err := c.Do(stats.attach(req))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	stats.gotResponse(resp)
+
+	var buf bytes.Buffer
+	writeHeaders(&buf, stats)
+	if !strings.HasPrefix(buf.String(), "HTTP/1.1 200 OK\r\n") || !strings.Contains(buf.String(), "\r\nX-Test: yes\r\n") {
+		t.Errorf("Unexpected headers %q", buf.String())
+	}
+	if resp.TLS == nil || !resp.TLS.HandshakeComplete {
+		t.Error("Expected the TLS state of the response")
+	}
+}
+
+func TestSynthHeader(t *testing.T) {
+	t.Log("Testing synthHeader()... (expecting HTTP/2 headers in lower case, sorted by name)")
+
+	resp := &http.Response{
+		Proto:      "HTTP/2.0",
+		ProtoMajor: 2,
+		StatusCode: 200,
+		Header:     http.Header{"X-Test": {"a", "b"}, "Content-Type": {"text/plain"}, "Age": {"1"}},
+	}
+	expected := "HTTP/2 200\r\nage: 1\r\ncontent-type: text/plain\r\nx-test: a\r\nx-test: b\r\n\r\n"
+	if got := string(synthHeader(resp)); got != expected {
+		t.Errorf("Expected %q, but got %q", expected, got)
+	}
+}
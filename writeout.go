@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// readWriteOut returns the --write-out template, read from a file for
+// "@file", or from the standard input for "@-".
+func readWriteOut(arg string) (string, error) {
+	if !strings.HasPrefix(arg, "@") {
+		return arg, nil
+	}
+	var data []byte
+	var err error
+	if arg == "@-" {
+		data, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		data, err = ioutil.ReadFile(arg[1:])
+	}
+	if err != nil {
+		return "", fmt.Errorf("unable to read the write-out template; %s", err)
+	}
+	return string(data), nil
+}
+
+// writeOut expands the --write-out template with the statistics of the
+// transfer, using cURL's syntax: %{variable}, %header{name}, %% and the \n,
+// \r and \t escapes. The output goes to stdout, or to stderr after a
+// %{stderr}.
+func writeOut(tmpl string, s *transferStats, stdout, stderr io.Writer) {
+	w := stdout
+	var vars map[string]interface{}
+
+	for len(tmpl) > 0 {
+		switch {
+		case strings.HasPrefix(tmpl, "%%"):
+			io.WriteString(w, "%")
+			tmpl = tmpl[2:]
+
+		case strings.HasPrefix(tmpl, "%{") || strings.HasPrefix(tmpl, "%header{"):
+			end := strings.IndexByte(tmpl, '}')
+			if end < 0 {
+				io.WriteString(w, tmpl)
+				return
+			}
+			name := tmpl[strings.IndexByte(tmpl, '{')+1 : end]
+			isHeader := strings.HasPrefix(tmpl, "%header{")
+			tmpl = tmpl[end+1:]
+
+			if vars == nil {
+				vars = s.writeOutVars()
+			}
+			switch {
+			case isHeader:
+				if h := s.last(); h != nil && h.resp != nil {
+					io.WriteString(w, strings.Join(h.resp.Header.Values(name), ", "))
+				}
+			case name == "stdout":
+				w = stdout
+			case name == "stderr":
+				w = stderr
+			case name == "json":
+				data, _ := json.Marshal(vars)
+				w.Write(data)
+			case name == "header_json":
+				header := http.Header{}
+				if h := s.last(); h != nil && h.resp != nil {
+					header = h.resp.Header
+				}
+				data, _ := json.Marshal(header)
+				w.Write(data)
+			default:
+				v, ok := vars[name]
+				if !ok {
+					Status.Printf(" unknown --write-out variable: '%s'\n", name)
+					continue
+				}
+				if f, ok := v.(float64); ok {
+					fmt.Fprintf(w, "%.6f", f)
+				} else {
+					fmt.Fprint(w, v)
+				}
+			}
+
+		case strings.HasPrefix(tmpl, "\\") && len(tmpl) > 1:
+			switch tmpl[1] {
+			case 'n':
+				io.WriteString(w, "\n")
+			case 'r':
+				io.WriteString(w, "\r")
+			case 't':
+				io.WriteString(w, "\t")
+			default:
+				io.WriteString(w, tmpl[:2])
+			}
+			tmpl = tmpl[2:]
+
+		default:
+			next := strings.IndexAny(tmpl[1:], "%\\")
+			if next < 0 {
+				io.WriteString(w, tmpl)
+				return
+			}
+			io.WriteString(w, tmpl[:next+1])
+			tmpl = tmpl[next+1:]
+		}
+	}
+}
+
+// writeOutVars returns the --write-out variables of the transfer. The times
+// are float64 seconds, the sizes and counts are int64 or int.
+func (s *transferStats) writeOutVars() map[string]interface{} {
+	namelookup, connect, appconnect, pretransfer, starttransfer := s.phases()
+	redirect := s.redirectTime()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	total := s.end.Sub(s.start)
+	redirects := 0
+	if len(s.hops) > s.firstHop+1 {
+		redirects = len(s.hops) - s.firstHop - 1
+	}
+
+	vars := map[string]interface{}{
+		"content_type":       "",
+		"errormsg":           "",
+		"exitcode":           exitCodeFor(s.err),
+		"filename_effective": s.outputFile,
+		"http_code":          0,
+		"http_connect":       0,
+		"http_version":       "0",
+		"local_ip":           "",
+		"local_port":         0,
+		"method":             "",
+		"num_connects":       s.numConns,
+		"num_headers":        0,
+		"num_redirects":      redirects,
+		"num_retries":        s.retries,
+		"redirect_url":       "",
+		"remote_ip":          "",
+		"remote_port":        0,
+		"response_code":      0,
+		"scheme":             "",
+		"size_download":      s.downloaded,
+		"size_header":        int64(0),
+		"size_request":       int64(0),
+		"size_upload":        s.uploaded,
+		"speed_download":     speed(s.downloaded, total),
+		"speed_upload":       speed(s.uploaded, total),
+		"ssl_verify_result":  0,
+		"time_appconnect":    appconnect.Seconds(),
+		"time_connect":       connect.Seconds(),
+		"time_namelookup":    namelookup.Seconds(),
+		"time_pretransfer":   pretransfer.Seconds(),
+		"time_redirect":      redirect.Seconds(),
+		"time_starttransfer": starttransfer.Seconds(),
+		"time_total":         total.Seconds(),
+		"url":                "",
+		"url_effective":      "",
+		"urlnum":             s.urlNum,
+	}
+	if s.err != nil {
+		vars["errormsg"] = s.err.Error()
+	}
+
+	var sizeHeader, sizeRequest int64
+	for _, h := range s.hops {
+		sizeRequest += requestHeaderSize(h.req)
+		if h.resp != nil {
+			sizeHeader += responseHeaderSize(h.resp)
+		}
+	}
+	vars["size_header"] = sizeHeader
+	vars["size_request"] = sizeRequest
+
+	if len(s.hops) == 0 {
+		return vars
+	}
+	first, h := s.hops[0], s.hops[len(s.hops)-1]
+	vars["url"] = first.req.URL.String()
+	vars["url_effective"] = h.req.URL.String()
+	vars["method"] = h.req.Method
+	vars["scheme"] = strings.ToUpper(h.req.URL.Scheme)
+	if h.remoteAddr != "" {
+		host, port := splitAddr(h.remoteAddr)
+		vars["remote_ip"] = host
+		vars["remote_port"] = atoiOrZero(port)
+	}
+	if h.localAddr != "" {
+		host, port := splitAddr(h.localAddr)
+		vars["local_ip"] = host
+		vars["local_port"] = atoiOrZero(port)
+	}
+	if resp := h.resp; resp != nil {
+		vars["http_code"] = resp.StatusCode
+		vars["response_code"] = resp.StatusCode
+		vars["http_version"] = strings.TrimPrefix(protoName(resp), "HTTP/")
+		vars["content_type"] = resp.Header.Get("Content-Type")
+		vars["num_headers"] = len(resp.Header)
+		if loc, err := resp.Location(); err == nil && resp.StatusCode/100 == 3 {
+			vars["redirect_url"] = loc.String()
+		}
+	}
+	return vars
+}
+
+// requestHeaderSize returns the size of the request line and the headers of
+// req, as they are sent over HTTP/1.1.
+func requestHeaderSize(req *http.Request) int64 {
+	n := len(req.Method) + len(req.URL.RequestURI()) + len(" HTTP/1.1\r\n")
+	n += len("Host: \r\n") + len(req.URL.Host)
+	for k, vs := range req.Header {
+		if k == "Host" {
+			continue
+		}
+		for _, v := range vs {
+			n += len(k) + len(v) + len(": \r\n")
+		}
+	}
+	return int64(n + len("\r\n"))
+}
+
+// responseHeaderSize returns the size of the status line and the headers of
+// resp, as they are received over HTTP/1.1.
+func responseHeaderSize(resp *http.Response) int64 {
+	n := len(protoName(resp)) + len(resp.Status) + len(" \r\n")
+	for k, vs := range resp.Header {
+		for _, v := range vs {
+			n += len(k) + len(v) + len(": \r\n")
+		}
+	}
+	return int64(n + len("\r\n"))
+}
+
+// speed returns the average speed, in bytes per second, of n bytes
+// transferred in d.
+func speed(n int64, d time.Duration) int64 {
+	if d <= 0 {
+		return 0
+	}
+	return int64(float64(n) / d.Seconds())
+}
+
+func atoiOrZero(s string) int {
+	n, _ := strconv.Atoi(s)
+	return n
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWriteOut(t *testing.T) {
+	t.Log("Testing writeOut()... (expecting the variables of a redirected transfer)")
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/old" {
+			http.Redirect(w, r, "/new", http.StatusFound)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("X-Test", "yes")
+		io.WriteString(w, "hello")
+	}))
+	defer srv.Close()
+
+	stats := newTransferStats(0)
+	c := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		statsFromContext(req.Context()).redirect(req)
+		return nil
+	}}
+	req, _ := http.NewRequest("GET", srv.URL+"/old", nil)
+	resp, err := c.Do(stats.attach(req))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats.gotResponse(resp)
+	ioutil.ReadAll(&countingReader{resp.Body, &stats.downloaded})
+	resp.Body.Close()
+	stats.finish(nil)
+
+	var stdout, stderr bytes.Buffer
+	writeOut(`%{http_code} %{num_redirects} %{url_effective} %{content_type} %{size_download} %header{x-test} 100%%\t%{stderr}%{method}\n`, stats, &stdout, &stderr)
+	want := "200 1 " + srv.URL + "/new text/plain 5 yes 100%\t"
+	if stdout.String() != want {
+		t.Errorf("Expected %q, but got %q", want, stdout.String())
+	}
+	if stderr.String() != "GET\n" {
+		t.Errorf("Expected %q on stderr, but got %q", "GET\n", stderr.String())
+	}
+
+	stdout.Reset()
+	writeOut("%{json}", stats, &stdout, &stderr)
+	var vars map[string]interface{}
+	if err := json.Unmarshal(stdout.Bytes(), &vars); err != nil {
+		t.Fatalf("Invalid %%{json} output %q : %s", stdout.String(), err)
+	}
+	phases := []string{"time_namelookup", "time_connect", "time_pretransfer", "time_starttransfer", "time_total"}
+	for i := 1; i < len(phases); i++ {
+		if vars[phases[i]].(float64) < vars[phases[i-1]].(float64) {
+			t.Errorf("Expected %s >= %s, but got %v", phases[i], phases[i-1], vars)
+		}
+	}
+	if vars["time_redirect"].(float64) <= 0 || !strings.HasPrefix(vars["remote_ip"].(string), "127.0.0.1") {
+		t.Errorf("Unexpected redirect time or remote IP in %v", vars)
+	}
+}